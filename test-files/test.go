@@ -2,15 +2,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // Constants
@@ -20,16 +44,59 @@ const (
 	BaseURL        = "https://api.example.com"
 )
 
+// Format is an export format
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatXML    Format = "xml"
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
 // Supported formats
-var SupportedFormats = []string{"json", "xml", "csv"}
+var SupportedFormats = []Format{FormatJSON, FormatXML, FormatCSV, FormatNDJSON}
+
+// ParseFormat converts a format name, in any case, into a supported Format
+func ParseFormat(name string) (Format, error) {
+	format := Format(strings.ToLower(strings.TrimSpace(name)))
+	if !slices.Contains(SupportedFormats, format) {
+		return "", fmt.Errorf("unsupported format: %q", name)
+	}
+	return format, nil
+}
+
+// String implements the Stringer interface
+func (f Format) String() string {
+	return string(f)
+}
+
+// ContentType returns the MIME type to serve the format with
+func (f Format) ContentType() string {
+	switch f {
+	case FormatJSON:
+		return "application/json"
+	case FormatXML:
+		return "application/xml"
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/octet-stream"
+	}
+}
 
 // Custom error types
 var (
-	ErrUserNotFound   = errors.New("user not found")
-	ErrInvalidEmail   = errors.New("invalid email format")
-	ErrAPIError       = errors.New("API request failed")
-	ErrEmptyUserID    = errors.New("user ID cannot be empty")
-	ErrEmptyUserName  = errors.New("user name cannot be empty")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInvalidEmail        = errors.New("invalid email format")
+	ErrAPIError            = errors.New("API request failed")
+	ErrEmptyUserID         = errors.New("user ID cannot be empty")
+	ErrEmptyUserName       = errors.New("user name cannot be empty")
+	ErrUserExists          = errors.New("user already exists")
+	ErrDecodeResponse      = errors.New("malformed response body")
+	ErrResultLimitExceeded = errors.New("result limit exceeded")
 )
 
 // UserStatus represents the status of a user
@@ -58,11 +125,43 @@ func (s UserStatus) String() string {
 	}
 }
 
+// ParseUserStatus converts a status name into a UserStatus
+func ParseUserStatus(str string) (UserStatus, error) {
+	switch str {
+	case "active":
+		return StatusActive, nil
+	case "inactive":
+		return StatusInactive, nil
+	case "pending":
+		return StatusPending, nil
+	case "suspended":
+		return StatusSuspended, nil
+	default:
+		return 0, fmt.Errorf("invalid user status: %s", str)
+	}
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (s UserStatus) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.String())
 }
 
+// MarshalText implements the encoding.TextMarshaler interface
+func (s UserStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (s *UserStatus) UnmarshalText(text []byte) error {
+	status, err := ParseUserStatus(string(text))
+	if err != nil {
+		return err
+	}
+
+	*s = status
+	return nil
+}
+
 // UnmarshalJSON implements the json.Unmarshaler interface
 func (s *UserStatus) UnmarshalJSON(data []byte) error {
 	var str string
@@ -70,19 +169,12 @@ func (s *UserStatus) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	switch str {
-	case "active":
-		*s = StatusActive
-	case "inactive":
-		*s = StatusInactive
-	case "pending":
-		*s = StatusPending
-	case "suspended":
-		*s = StatusSuspended
-	default:
-		return fmt.Errorf("invalid user status: %s", str)
+	status, err := ParseUserStatus(str)
+	if err != nil {
+		return err
 	}
 
+	*s = status
 	return nil
 }
 
@@ -93,13 +185,15 @@ func (s UserStatus) IsValid() bool {
 
 // User represents a user in the system
 type User struct {
-	ID        string                 `json:"id"`
-	Name      string                 `json:"name"`
-	Email     string                 `json:"email"`
-	Status    UserStatus             `json:"status"`
-	CreatedAt time.Time              `json:"created_at"`
-	Metadata  map[string]interface{} `json:"metadata"`
+	ID        string                 `json:"id" xml:"id"`
+	Name      string                 `json:"name" xml:"name"`
+	Email     string                 `json:"email" xml:"email"`
+	Status    UserStatus             `json:"status" xml:"status"`
+	CreatedAt time.Time              `json:"created_at" xml:"created_at"`
+	Metadata  map[string]interface{} `json:"metadata" xml:"-"`
 	mu        sync.RWMutex           `json:"-"`
+
+	rawMetadata json.RawMessage // metadata as received, until prepareUser
 }
 
 // NewUser creates a new user with validation
@@ -110,8 +204,8 @@ func NewUser(id, name, email string) (*User, error) {
 	if name == "" {
 		return nil, ErrEmptyUserName
 	}
-	if !isValidEmail(email) {
-		return nil, fmt.Errorf("%w: %s", ErrInvalidEmail, email)
+	if err := ValidateEmail(email); err != nil {
+		return nil, err
 	}
 
 	return &User{
@@ -143,9 +237,15 @@ func (u *User) DisplayName() string {
 
 // DaysActive returns the number of days the user has been active
 func (u *User) DaysActive() int {
+	return u.DaysActiveAt(time.Now())
+}
+
+// DaysActiveAt returns the number of days the user has been active as of
+// the given time
+func (u *User) DaysActiveAt(now time.Time) int {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	return int(time.Since(u.CreatedAt).Hours() / 24)
+	return int(now.Sub(u.CreatedAt).Hours() / 24)
 }
 
 // SetStatus sets the user status safely
@@ -162,6 +262,16 @@ func (u *User) AddMetadata(key string, value interface{}) {
 	u.Metadata[key] = value
 }
 
+// ReplaceMetadata atomically replaces all of the user's metadata with a deep
+// copy of md, so later changes to md don't affect the user. A nil md leaves
+// the user with empty metadata.
+func (u *User) ReplaceMetadata(md map[string]interface{}) {
+	copied := copyMetadata(md)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Metadata = copied
+}
+
 // GetMetadata gets metadata from the user safely
 func (u *User) GetMetadata(key string) (interface{}, bool) {
 	u.mu.RLock()
@@ -170,268 +280,5065 @@ func (u *User) GetMetadata(key string) (interface{}, bool) {
 	return value, exists
 }
 
-// String implements the Stringer interface
-func (u *User) String() string {
-	u.mu.RLock()
-	defer u.mu.RUnlock()
-	return fmt.Sprintf("User(id=%s, name=%s, email=%s, status=%s)", u.ID, u.Name, u.Email, u.Status)
-}
-
-// Validate validates the user data
-func (u *User) Validate() error {
+// GetMetadataJSON returns the metadata marshaled as a JSON object. Keys of
+// the metadata map and of nested maps are written in sorted order.
+func (u *User) GetMetadataJSON() ([]byte, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
-	if u.ID == "" {
-		return ErrEmptyUserID
+	if u.Metadata == nil {
+		return []byte("{}"), nil
 	}
-	if u.Name == "" {
-		return ErrEmptyUserName
+	data, err := json.Marshal(u.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
-	if !isValidEmail(u.Email) {
-		return fmt.Errorf("%w: %s", ErrInvalidEmail, u.Email)
+	return data, nil
+}
+
+// SetMetadataJSON replaces the metadata with the JSON object in data. A JSON
+// null clears the metadata; anything other than an object is an error and
+// leaves the metadata unchanged.
+func (u *User) SetMetadataJSON(data []byte) error {
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return fmt.Errorf("invalid metadata JSON: %w", err)
 	}
-	if !u.Status.IsValid() {
-		return fmt.Errorf("invalid user status: %d", u.Status)
+	if metadata == nil {
+		metadata = make(map[string]interface{})
 	}
 
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Metadata = metadata
 	return nil
 }
 
-// ApiResponse represents a generic API response
-type ApiResponse[T any] struct {
-	Success   bool      `json:"success"`
-	Data      *T        `json:"data,omitempty"`
-	Error     *string   `json:"error,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
-}
+// GetMetadataInt gets a metadata value as an integer. It accepts any integer
+// type, json.Number, and floats or strings holding a whole number; ok is
+// false if the key is missing or the value is not an integer.
+func (u *User) GetMetadataInt(key string) (int64, bool) {
+	value, exists := u.GetMetadata(key)
+	if !exists {
+		return 0, false
+	}
 
-// NewSuccessResponse creates a successful API response
-func NewSuccessResponse[T any](data T) *ApiResponse[T] {
-	return &ApiResponse[T]{
-		Success:   true,
-		Data:      &data,
-		Timestamp: time.Now().UTC(),
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), v <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float32:
+		return floatToInt(float64(v))
+	case float64:
+		return floatToInt(v)
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	default:
+		return 0, false
 	}
 }
 
-// NewErrorResponse creates an error API response
-func NewErrorResponse[T any](errMsg string) *ApiResponse[T] {
-	return &ApiResponse[T]{
-		Success:   false,
-		Error:     &errMsg,
-		Timestamp: time.Now().UTC(),
+// floatToInt converts f to an int64 if it holds a whole number in range
+func floatToInt(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
 	}
+	return int64(f), true
 }
 
-// UserManager manages user operations
-type UserManager struct {
-	cache      sync.Map
-	baseURL    string
-	client     *http.Client
-	timeout    time.Duration
-	maxRetries int
-}
+// CompactMetadata removes metadata entries whose value is empty, as defined
+// by IsEmptyMetadataValue, and returns how many were removed
+func (u *User) CompactMetadata() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-// NewUserManager creates a new user manager
-func NewUserManager(baseURL string) *UserManager {
-	return &UserManager{
-		baseURL: baseURL,
-		client: &http.Client{
-			Timeout: TimeoutSeconds * time.Second,
-		},
-		timeout:    TimeoutSeconds * time.Second,
-		maxRetries: MaxRetries,
+	removed := 0
+	for key, value := range u.Metadata {
+		if IsEmptyMetadataValue(value) {
+			delete(u.Metadata, key)
+			removed++
+		}
 	}
+	return removed
 }
 
-// FetchUser fetches a user by ID with caching
-func (um *UserManager) FetchUser(ctx context.Context, userID string) (*User, error) {
-	if userID == "" {
-		return nil, ErrEmptyUserID
+// IsEmptyMetadataValue reports whether a metadata value is empty: nil, the
+// empty string, or a slice or map of any type with no elements. Zero
+// numbers and false are not empty.
+func IsEmptyMetadataValue(value interface{}) bool {
+	if value == nil {
+		return true
 	}
-
-	// Check cache first
-	if cached, ok := um.cache.Load(userID); ok {
-		log.Printf("User %s found in cache", userID)
-		return cached.(*User), nil
+	if str, ok := value.(string); ok {
+		return str == ""
 	}
 
-	// Fetch from API
-	url := fmt.Sprintf("%s/users/%s", um.baseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return false
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Go-UserManager/1.0")
+// String implements the Stringer interface
+func (u *User) String() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return fmt.Sprintf("User(id=%s, name=%s, email=%s, status=%s)", u.ID, u.Name, u.Email, u.Status)
+}
 
-	resp, err := um.client.Do(req)
-	if err != nil {
-		log.Printf("Failed to fetch user %s: %v", userID, err)
-		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+// ToMap returns the user as a map with id, name, email, status (as its
+// string form), created_at and a copy of the metadata
+func (u *User) ToMap() map[string]interface{} {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return map[string]interface{}{
+		"id":         u.ID,
+		"name":       u.Name,
+		"email":      u.Email,
+		"status":     u.Status.String(),
+		"created_at": u.CreatedAt,
+		"metadata":   copyMetadata(u.Metadata),
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to fetch user %s: status %d", userID, resp.StatusCode)
-		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+// Equal reports whether u and other hold the same fields. Status is compared
+// by value, CreatedAt as an instant and metadata deeply, with nil and empty
+// metadata treated alike. Two nil users are equal.
+func (u *User) Equal(other *User) bool {
+	if u == nil || other == nil {
+		return u == other
+	}
+	if u == other {
+		return true
 	}
 
-	var apiResp ApiResponse[User]
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	// Snapshot each user under its own lock rather than holding both
+	type fields struct {
+		id, name, email string
+		status          UserStatus
+		createdAt       time.Time
+		metadata        map[string]interface{}
 	}
+	snapshot := func(x *User) fields {
+		x.mu.RLock()
+		defer x.mu.RUnlock()
+		return fields{x.ID, x.Name, x.Email, x.Status, x.CreatedAt, copyMetadata(x.Metadata)}
+	}
+
+	a, b := snapshot(u), snapshot(other)
+	return a.id == b.id && a.name == b.name && a.email == b.email &&
+		a.status == b.status && a.createdAt.Equal(b.createdAt) &&
+		reflect.DeepEqual(a.metadata, b.metadata)
+}
 
-	if !apiResp.Success {
-		errMsg := "unknown error"
-		if apiResp.Error != nil {
-			errMsg = *apiResp.Error
+// DiffUserSets compares two snapshots of users by ID. added and changed hold
+// users from newUsers, in its order: those whose ID is missing from oldUsers
+// and those whose fields differ from their old version. removed holds users
+// from oldUsers whose ID is missing from newUsers, in its order. Nil users
+// are skipped, and where an ID appears more than once within a snapshot its
+// last occurrence wins.
+func DiffUserSets(oldUsers, newUsers []*User) (added, removed, changed []*User) {
+	byID := func(users []*User) (map[string]*User, []string) {
+		index := make(map[string]*User, len(users))
+		var order []string
+		for _, user := range users {
+			if user == nil {
+				continue
+			}
+			user.mu.RLock()
+			id := user.ID
+			user.mu.RUnlock()
+			if _, ok := index[id]; !ok {
+				order = append(order, id)
+			}
+			index[id] = user
 		}
-		return nil, fmt.Errorf("%w: %s", ErrAPIError, errMsg)
+		return index, order
 	}
 
-	if apiResp.Data == nil {
-		return nil, ErrUserNotFound
-	}
+	oldIndex, oldOrder := byID(oldUsers)
+	newIndex, newOrder := byID(newUsers)
 
-	// Cache the result
-	um.cache.Store(userID, apiResp.Data)
-	log.Printf("User %s fetched and cached successfully", userID)
+	for _, id := range newOrder {
+		user := newIndex[id]
+		previous, ok := oldIndex[id]
+		switch {
+		case !ok:
+			added = append(added, user)
+		case !previous.Equal(user):
+			changed = append(changed, user)
+		}
+	}
+	for _, id := range oldOrder {
+		if _, ok := newIndex[id]; !ok {
+			removed = append(removed, oldIndex[id])
+		}
+	}
+	return added, removed, changed
+}
 
-	return apiResp.Data, nil
+// Index looks users up by ID or email in constant time. It is a snapshot
+// taken by BuildUserIndex: users added, removed or changed afterwards are not
+// reflected, so rebuild it when the underlying users change.
+type Index struct {
+	byID    map[string]*User
+	byEmail map[string]*User
 }
 
-// BatchFetchUsers fetches multiple users concurrently
-func (um *UserManager) BatchFetchUsers(ctx context.Context, userIDs []string) map[string]*User {
-	results := make(map[string]*User)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
+// BuildUserIndex indexes users by ID and lowercased email. Nil users are
+// skipped, and where an ID or email appears more than once the last user
+// wins.
+func BuildUserIndex(users []*User) *Index {
+	index := &Index{
+		byID:    make(map[string]*User, len(users)),
+		byEmail: make(map[string]*User, len(users)),
+	}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		user.mu.RLock()
+		index.byID[user.ID] = user
+		index.byEmail[strings.ToLower(user.Email)] = user
+		user.mu.RUnlock()
+	}
+	return index
+}
 
-	// Create a semaphore to limit concurrent requests
-	semaphore := make(chan struct{}, 10)
+// ByID returns the user with the given ID
+func (x *Index) ByID(id string) (*User, bool) {
+	user, ok := x.byID[id]
+	return user, ok
+}
 
-	for _, userID := range userIDs {
-		wg.Add(1)
-		go func(id string) {
-			defer wg.Done()
-			semaphore <- struct{}{} // Acquire
-			defer func() { <-semaphore }() // Release
+// ByEmail returns the user with the given email, ignoring case
+func (x *Index) ByEmail(email string) (*User, bool) {
+	user, ok := x.byEmail[strings.ToLower(email)]
+	return user, ok
+}
 
-			user, err := um.FetchUser(ctx, id)
+// Len returns the number of users indexed by ID
+func (x *Index) Len() int {
+	return len(x.byID)
+}
 
-			mu.Lock()
-			if err != nil {
-				log.Printf("Error fetching user %s: %v", id, err)
-				results[id] = nil
-			} else {
-				results[id] = user
-			}
-			mu.Unlock()
-		}(userID)
+// UserFromMap builds a user from a loosely-typed map such as decoded YAML or
+// form input. id, name and email are required strings; status (a name or a
+// UserStatus) and created_at (a time.Time or RFC 3339 string) are optional.
+// A "metadata" map is copied into Metadata, as are any other keys, so the
+// output of ToMap round-trips.
+func UserFromMap(m map[string]interface{}) (*User, error) {
+	requiredString := func(key string) (string, error) {
+		value, ok := m[key]
+		if !ok {
+			return "", fmt.Errorf("missing required field %q", key)
+		}
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("field %q must be a string, got %T", key, value)
+		}
+		return str, nil
 	}
 
-	wg.Wait()
-	return results
-}
-
-// UpdateUser updates a user's information
-func (um *UserManager) UpdateUser(ctx context.Context, userID string, updates map[string]interface{}) error {
-	url := fmt.Sprintf("%s/users/%s", um.baseURL, userID)
+	user := &User{
+		Status:    StatusActive,
+		CreatedAt: time.Now().UTC(),
+		Metadata:  make(map[string]interface{}),
+	}
 
-	data, err := json.Marshal(updates)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updates: %w", err)
+	var err error
+	if user.ID, err = requiredString("id"); err != nil {
+		return nil, err
+	}
+	if user.Name, err = requiredString("name"); err != nil {
+		return nil, err
+	}
+	if user.Email, err = requiredString("email"); err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "PUT", url,
-		bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	if value, ok := m["status"]; ok {
+		switch v := value.(type) {
+		case string:
+			if user.Status, err = ParseUserStatus(v); err != nil {
+				return nil, err
+			}
+		case UserStatus:
+			user.Status = v
+		default:
+			return nil, fmt.Errorf("field %q must be a string, got %T", "status", value)
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	if value, ok := m["created_at"]; ok {
+		switch v := value.(type) {
+		case time.Time:
+			user.CreatedAt = v
+		case string:
+			createdAt, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid created_at: %w", err)
+			}
+			user.CreatedAt = createdAt
+		default:
+			return nil, fmt.Errorf("field %q must be a time or string, got %T", "created_at", value)
+		}
+	}
 
-	resp, err := um.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("%w: %v", ErrAPIError, err)
+	for key, value := range m {
+		switch key {
+		case "id", "name", "email", "status", "created_at":
+		case "metadata":
+			md, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("field %q must be a map, got %T", key, value)
+			}
+			for mdKey, mdValue := range md {
+				user.Metadata[mdKey] = copyMetadataValue(mdValue)
+			}
+		default:
+			user.Metadata[key] = copyMetadataValue(value)
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	if err := user.Validate(); err != nil {
+		return nil, err
 	}
+	return user, nil
+}
 
-	// Invalidate cache
-	um.cache.Delete(userID)
-	log.Printf("User %s updated successfully", userID)
+// copyMetadata deep-copies a metadata map, including nested generic maps
+// and slices, so the copy shares no mutable state with the original
+func copyMetadata(md map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(md))
+	for key, value := range md {
+		copied[key] = copyMetadataValue(value)
+	}
+	return copied
+}
 
-	return nil
+// copyMetadataValue deep-copies generic maps and slices and returns any
+// other value unchanged
+func copyMetadataValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyMetadata(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyMetadataValue(item)
+		}
+		return copied
+	default:
+		return value
+	}
 }
 
-// FilterUsersByStatus filters users by status
-func (um *UserManager) FilterUsersByStatus(users []*User, status UserStatus) []*User {
-	var filtered []*User
-	for _, user := range users {
-		if user.Status == status {
-			filtered = append(filtered, user)
+// modifiedAt returns the user's updated_at metadata time, or CreatedAt
+func (u *User) modifiedAt() time.Time {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if value, ok := u.Metadata[UpdatedAtMetadataKey]; ok {
+		if updatedAt, ok := metadataTime(value); ok {
+			return updatedAt
 		}
 	}
-	return filtered
+	return u.CreatedAt
 }
 
-// UserStatistics represents user statistics
-type UserStatistics struct {
-	Total              int     `json:"total"`
-	Active             int     `json:"active"`
-	Inactive           int     `json:"inactive"`
-	Pending            int     `json:"pending"`
-	Suspended          int     `json:"suspended"`
-	AverageDaysActive  float64 `json:"average_days_active"`
+// marshalJSON encodes the user under its read lock
+func (u *User) marshalJSON() ([]byte, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return json.Marshal(u)
 }
 
-// GetUserStatistics calculates user statistics
-func (um *UserManager) GetUserStatistics(users []*User) UserStatistics {
-	stats := UserStatistics{
-		Total: len(users),
+// UnmarshalJSON implements the json.Unmarshaler interface. Besides the
+// usual decoding it keeps the metadata exactly as received, so the manager
+// can hand it to a metadata deserializer or decode its numbers losslessly.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	aux := struct {
+		*plain
+		Metadata json.RawMessage `json:"metadata"`
+	}{plain: (*plain)(u)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
 
-	if len(users) == 0 {
-		return stats
+	// Like encoding/json, leave Metadata alone when the key is absent and
+	// clear it for an explicit null
+	u.rawMetadata = nil
+	if len(aux.Metadata) == 0 {
+		return nil
 	}
-
-	totalDays := 0
-	for _, user := range users {
-		switch user.Status {
-		case StatusActive:
-			stats.Active++
-		case StatusInactive:
-			stats.Inactive++
-		case StatusPending:
-			stats.Pending++
-		case StatusSuspended:
-			stats.Suspended++
-		}
-		totalDays += user.DaysActive()
+	if string(aux.Metadata) == "null" {
+		u.Metadata = nil
+		return nil
 	}
-
-	stats.AverageDaysActive = float64(totalDays) / float64(len(users))
-	return stats
+	u.rawMetadata = aux.Metadata
+	return json.Unmarshal(aux.Metadata, &u.Metadata)
 }
 
-// ClearCache clears the user cache and returns the number of entries cleared
-func (um *UserManager) ClearCache() int {
-	count := 0
+// Validate validates the user data
+func (u *User) Validate() error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if u.ID == "" {
+		return ErrEmptyUserID
+	}
+	if u.Name == "" {
+		return ErrEmptyUserName
+	}
+	if err := ValidateEmail(u.Email); err != nil {
+		return err
+	}
+	if !u.Status.IsValid() {
+		return fmt.Errorf("invalid user status: %d", u.Status)
+	}
+
+	return nil
+}
+
+// ValidateUsers validates every user and reports all failures together
+func ValidateUsers(users []*User) error {
+	return validateAll(users, (*User).Validate)
+}
+
+// validateAll runs validate on every user and joins the failures
+func validateAll(users []*User, validate func(*User) error) error {
+	var errs []error
+	for i, user := range users {
+		if user == nil {
+			errs = append(errs, fmt.Errorf("user %d: user is nil", i))
+			continue
+		}
+		if err := validate(user); err != nil {
+			errs = append(errs, fmt.Errorf("user %d (%s): %w", i, user.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ApiResponse represents a generic API response
+type ApiResponse[T any] struct {
+	Success   bool      `json:"success" xml:"success"`
+	Data      *T        `json:"data,omitempty" xml:"data,omitempty"`
+	Error     *string   `json:"error,omitempty" xml:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp" xml:"timestamp"`
+}
+
+// Err returns nil for a successful response and otherwise an ErrAPIError
+// carrying the response's error message. A response with a 2xx status but
+// Success false is an application error like any other.
+func (r *ApiResponse[T]) Err() error {
+	if r.Success {
+		return nil
+	}
+	errMsg := "unknown error"
+	if r.Error != nil {
+		errMsg = *r.Error
+	}
+	return fmt.Errorf("%w: %s", ErrAPIError, errMsg)
+}
+
+// NewSuccessResponse creates a successful API response
+func NewSuccessResponse[T any](data T) *ApiResponse[T] {
+	return &ApiResponse[T]{
+		Success:   true,
+		Data:      &data,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// NewErrorResponse creates an error API response
+func NewErrorResponse[T any](errMsg string) *ApiResponse[T] {
+	return &ApiResponse[T]{
+		Success:   false,
+		Error:     &errMsg,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// ResponseFrom creates an error response from err if it is non-nil and a
+// successful response carrying data otherwise
+func ResponseFrom[T any](data T, err error) *ApiResponse[T] {
+	if err != nil {
+		return NewErrorResponse[T](err.Error())
+	}
+	return NewSuccessResponse(data)
+}
+
+// ResponseFromPtr is ResponseFrom for pointer results, treating nil data
+// without an error as an error response as well
+func ResponseFromPtr[T any](data *T, err error) *ApiResponse[T] {
+	if err != nil {
+		return NewErrorResponse[T](err.Error())
+	}
+	if data == nil {
+		return NewErrorResponse[T]("no data")
+	}
+	// Point at data rather than copying it, as T may hold a lock
+	return &ApiResponse[T]{
+		Success:   true,
+		Data:      data,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// WriteJSON writes resp as the JSON body of an HTTP response with the given
+// status code. Encoding errors can no longer change the status, so they are
+// only logged.
+func WriteJSON[T any](w http.ResponseWriter, status int, resp *ApiResponse[T]) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// WriteError writes an error response for err with the given status code
+func WriteError[T any](w http.ResponseWriter, status int, err error) {
+	errMsg := http.StatusText(status)
+	if err != nil {
+		errMsg = err.Error()
+	}
+	WriteJSON(w, status, NewErrorResponse[T](errMsg))
+}
+
+// UserManager manages user operations
+type UserManager struct {
+	cache       sync.Map
+	clock       Clock
+	cacheTTL    time.Duration
+	ttlJitter   float64
+	cacheMaxAge time.Duration
+	refreshAt   float64
+	refreshing  sync.Map
+	queryCache  sync.Map
+	queryTTL    time.Duration
+	baseURL     string
+	client      *http.Client
+	timeout     time.Duration
+	maxRetries  int
+	headers     http.Header
+	timeFormat  string
+
+	defaultStatus  UserStatus
+	observer       CacheObserver
+	cacheKeyPrefix string
+	idGenerator    func() string
+
+	uncachedStatuses map[UserStatus]bool
+
+	normalizeEmails bool
+	lowercaseEmails bool
+
+	logFields       func(ctx context.Context) []interface{}
+	beforeRequest   func(*http.Request) error
+	afterResponse   func(*http.Response) error
+	httpTrace       bool
+	retryPredicate  func(resp *http.Response, err error) bool
+	retryStatuses   map[int]bool
+	statusRetries   map[int]int
+	errorClassifier func(status int, body []byte) error
+
+	userDecoder     func(io.Reader) (*User, error)
+	userEncoder     func(*User) ([]byte, error)
+	userTransformer func(*User) *User
+	useNumber       bool
+
+	metadataSerializer   func(map[string]interface{}) (json.RawMessage, error)
+	metadataDeserializer func(json.RawMessage) (map[string]interface{}, error)
+	skipMetadata         bool
+
+	rulesMu         sync.RWMutex
+	validationRules []validationRule
+
+	metrics      managerMetrics
+	rateLimit    atomic.Pointer[rateLimit]
+	serverOffset atomic.Int64 // server clock minus ours, in nanoseconds
+
+	customClient    bool
+	transportOpts   []func(*http.Transport)
+	sharedTransport bool
+	connectTimeout  time.Duration
+
+	limiter     *weightedSemaphore
+	batchWeight int64
+
+	deleteMissingOK bool
+	recoverPanics   bool
+
+	logBodies  bool
+	logRedacts []string
+
+	dryRun    bool
+	dryRunMu  sync.Mutex
+	dryRunLog []DryRunEntry
+
+	rawCap       int // set by WithRawResponseCapture, read without rawMu
+	rawMu        sync.Mutex
+	rawResponses []RawResponse
+	rawNext      int
+
+	latencyBudget  time.Duration
+	slowAsError    bool
+	minRequestTime time.Duration
+	deadlineHeader string
+
+	maxResults int
+	maxPages   int
+
+	baseCtx        context.Context
+	cancelBase     context.CancelFunc
+	background     context.Context
+	stopBackground context.CancelFunc
+	lifecycleMu    sync.Mutex
+	inflight       sync.WaitGroup
+	shutdown       bool
+}
+
+// Option configures a UserManager
+type Option func(*UserManager)
+
+// WithHeader sets a header sent with every request made by the manager
+func WithHeader(key, value string) Option {
+	return func(um *UserManager) {
+		um.headers.Set(key, value)
+	}
+}
+
+// WithAuthToken sets the bearer token sent in the Authorization header
+func WithAuthToken(token string) Option {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithHTTPClient replaces the HTTP client used for all requests
+func WithHTTPClient(client *http.Client) Option {
+	return func(um *UserManager) {
+		if client != nil {
+			um.client = client
+			um.customClient = true
+		}
+	}
+}
+
+// sharedTransport backs SharedTransport
+var (
+	sharedTransportOnce sync.Once
+	sharedTransport     *http.Transport
+)
+
+// SharedTransport returns a process-wide transport, created on first use as
+// a clone of http.DefaultTransport, for managers that should share one
+// connection pool instead of each building its own, e.g. one manager per
+// tenant. It is safe for concurrent use; callers must not modify it. Pass it
+// to WithHTTPClient, or use WithSharedTransport.
+func SharedTransport() *http.Transport {
+	sharedTransportOnce.Do(func() {
+		sharedTransport = http.DefaultTransport.(*http.Transport).Clone()
+	})
+	return sharedTransport
+}
+
+// WithSharedTransport makes the manager's own client use SharedTransport.
+// Transport options cannot be applied to the shared transport and are
+// ignored, as is this option with WithHTTPClient. Shutdown leaves the shared
+// transport's idle connections open for the managers still using it.
+func WithSharedTransport() Option {
+	return func(um *UserManager) {
+		um.sharedTransport = true
+	}
+}
+
+// withTransport registers a change to the transport the manager builds for
+// its own client. Transport options have no effect with WithHTTPClient.
+func withTransport(configure func(*http.Transport)) Option {
+	return func(um *UserManager) {
+		um.transportOpts = append(um.transportOpts, configure)
+	}
+}
+
+// WithMaxIdleConnsPerHost sets how many idle connections are kept per host
+func WithMaxIdleConnsPerHost(n int) Option {
+	return withTransport(func(t *http.Transport) {
+		t.MaxIdleConnsPerHost = n
+	})
+}
+
+// WithIdleConnTimeout sets how long idle connections are kept open
+func WithIdleConnTimeout(d time.Duration) Option {
+	return withTransport(func(t *http.Transport) {
+		t.IdleConnTimeout = d
+	})
+}
+
+// WithDialContext sets the function the manager's transport uses to open
+// connections, e.g. to tune dial timeouts
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return withTransport(func(t *http.Transport) {
+		t.DialContext = dial
+	})
+}
+
+// WithPreferIPv4 makes the manager's transport connect over IPv4 only, for
+// networks where IPv6 is broken and dials stall
+func WithPreferIPv4() Option {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = "tcp4"
+		}
+		return dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// WithConnectTimeout bounds how long the manager's transport may take to
+// open a connection, independently of the overall request timeout, so an
+// unreachable server fails fast while a slow one still gets the full
+// timeout. It wraps whatever dialer is configured, including WithDialContext
+// and WithPreferIPv4, regardless of option order.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(um *UserManager) {
+		if d <= 0 {
+			log.Printf("Ignoring non-positive connect timeout: %v", d)
+			return
+		}
+		um.connectTimeout = d
+	}
+}
+
+// WithSkipTLSVerify makes the manager's transport accept any server
+// certificate, for dev and CI servers with self-signed certificates. It
+// disables protection against man-in-the-middle attacks: never use it in
+// production.
+func WithSkipTLSVerify() Option {
+	return withTransport(func(t *http.Transport) {
+		log.Printf("WARNING: TLS certificate verification is disabled; do not use this in production")
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	})
+}
+
+// WithForceHTTP1 makes the manager's transport speak HTTP/1.1 only, for
+// upstreams that misbehave under HTTP/2 multiplexing. Each concurrent
+// request then needs its own connection, so heavy batch operations open
+// more connections and pay more TLS handshakes; raise
+// WithMaxIdleConnsPerHost to keep them reused.
+func WithForceHTTP1() Option {
+	return withTransport(func(t *http.Transport) {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	})
+}
+
+// Special time formats accepted by WithTimeFormat besides Go layouts
+const (
+	TimeFormatUnix      = "unix"
+	TimeFormatUnixMilli = "unixmilli"
+)
+
+// WithTimeFormat sets how the CSV and XML exports and ExportUsersJSONWith
+// write timestamps: a Go time layout, or TimeFormatUnix / TimeFormatUnixMilli
+// for epoch numbers. The default is time.RFC3339. Plain JSON and NDJSON, as
+// written by ExportUsersJSON, ExportUsersJSONStable, WriteUsers and
+// StreamUsersJSONArray, always use RFC 3339, so the formats ExportUsersMulti
+// produces can disagree when this is set.
+func WithTimeFormat(format string) Option {
+	return func(um *UserManager) {
+		um.timeFormat = format
+	}
+}
+
+// WithDefaultStatus sets the status given to users built with the manager's
+// NewUser. Invalid statuses are ignored and StatusActive remains the default.
+func WithDefaultStatus(status UserStatus) Option {
+	return func(um *UserManager) {
+		if !status.IsValid() {
+			log.Printf("Ignoring invalid default status: %d", status)
+			return
+		}
+		um.defaultStatus = status
+	}
+}
+
+// WithCacheObserver registers an observer notified of cache operations
+func WithCacheObserver(observer CacheObserver) Option {
+	return func(um *UserManager) {
+		um.observer = observer
+	}
+}
+
+// WithCacheKeyPrefix namespaces the manager's cache keys, so several managers
+// can share a cache, such as one from WithContextCache, without their users
+// colliding. ClearCache, DrainCache and background refresh only touch keys
+// under the prefix.
+func WithCacheKeyPrefix(prefix string) Option {
+	return func(um *UserManager) {
+		um.cacheKeyPrefix = prefix
+	}
+}
+
+// WithClock sets the clock the caches use for timestamps and expiry, and
+// raw response captures for their times, so tests can drive TTLs with a
+// FakeClock instead of sleeping
+func WithClock(clock Clock) Option {
+	return func(um *UserManager) {
+		if clock != nil {
+			um.clock = clock
+		}
+	}
+}
+
+// WithCacheTTL makes cached users expire ttl after they were stored, after
+// which FetchUser revalidates them with the API. By default entries never
+// expire.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(um *UserManager) {
+		um.cacheTTL = ttl
+	}
+}
+
+// WithCacheMaxAge bounds how old a cached user may get before it is
+// unusable altogether, like HTTP max-age on top of stale-while-revalidate:
+// past the TTL an entry is revalidated but can still be served by
+// FetchUserWithFallback, past maxAge it is never served. Age counts from when
+// the entry was last stored or revalidated. By default there is no limit.
+func WithCacheMaxAge(maxAge time.Duration) Option {
+	return func(um *UserManager) {
+		if maxAge <= 0 {
+			log.Printf("Ignoring non-positive cache max age: %v", maxAge)
+			return
+		}
+		um.cacheMaxAge = maxAge
+	}
+}
+
+// WithRefreshAhead makes FetchUser refresh a cached user in the background
+// when it is served within the last fraction of its TTL, so hot entries are
+// renewed before they expire instead of making a reader wait. The cached
+// copy is still returned immediately, and overlapping reads of the same user
+// share one refresh. fraction must be between 0 and 1 and only matters
+// together with WithCacheTTL; the default 0 disables refresh-ahead.
+func WithRefreshAhead(fraction float64) Option {
+	return func(um *UserManager) {
+		if fraction < 0 || fraction > 1 {
+			log.Printf("Ignoring invalid refresh-ahead fraction: %v", fraction)
+			return
+		}
+		um.refreshAt = fraction
+	}
+}
+
+// WithCacheTTLJitter randomizes each entry's TTL by up to plus or minus
+// fraction of it, so entries cached together don't all expire together.
+// fraction must be between 0 and 1; the default is 0.
+func WithCacheTTLJitter(fraction float64) Option {
+	return func(um *UserManager) {
+		if fraction < 0 || fraction > 1 {
+			log.Printf("Ignoring invalid cache TTL jitter: %v", fraction)
+			return
+		}
+		um.ttlJitter = fraction
+	}
+}
+
+// WithQueryCache caches the results of GetUsersByStatus and QueryUsers for
+// ttl, keyed by the full query and the WithHeaders headers of the context,
+// separately from the per-user cache. A context from WithContextCache gets a
+// query cache of its own. Any write through the manager invalidates every
+// query cached by the manager and by the write's context. By default query
+// results are not cached.
+func WithQueryCache(ttl time.Duration) Option {
+	return func(um *UserManager) {
+		um.queryTTL = ttl
+	}
+}
+
+// WithEmailNormalization makes NewUser, CreateUser, CreateUsers and Upsert
+// normalize emails with NormalizeEmail before validating and sending users,
+// to avoid case-variant duplicate accounts. It changes the stored values:
+// the users passed in are updated in place. lowercaseAll also lowercases
+// the local part, which most but not all mail servers treat
+// case-insensitively.
+func WithEmailNormalization(lowercaseAll bool) Option {
+	return func(um *UserManager) {
+		um.normalizeEmails = true
+		um.lowercaseEmails = lowercaseAll
+	}
+}
+
+// WithIDGenerator sets a function that mints IDs for users passed to
+// CreateUser or CreateUsers without one, e.g. UUIDs for idempotent creation.
+// By default users must already carry an ID.
+func WithIDGenerator(generate func() string) Option {
+	return func(um *UserManager) {
+		um.idGenerator = generate
+	}
+}
+
+// WithBaseContext ties the manager to a parent lifecycle: once ctx is
+// cancelled, in-flight requests are aborted and new ones fail immediately,
+// in addition to any deadline or cancellation of the per-call context.
+func WithBaseContext(ctx context.Context) Option {
+	return func(um *UserManager) {
+		if ctx != nil {
+			um.baseCtx = ctx
+		}
+	}
+}
+
+// WithUncachedStatuses prevents users with any of the given statuses from
+// being cached, so volatile users are always fetched fresh. By default users
+// of every status are cached.
+func WithUncachedStatuses(statuses ...UserStatus) Option {
+	return func(um *UserManager) {
+		if um.uncachedStatuses == nil {
+			um.uncachedStatuses = make(map[UserStatus]bool)
+		}
+		for _, status := range statuses {
+			um.uncachedStatuses[status] = true
+		}
+	}
+}
+
+// WithUserDecoder replaces the ApiResponse envelope decoding of single-user
+// responses (FetchUser, CreateUser, Upsert) with a custom decoder for APIs
+// with a different response shape. Returning a nil user means "no user".
+func WithUserDecoder(decode func(io.Reader) (*User, error)) Option {
+	return func(um *UserManager) {
+		um.userDecoder = decode
+	}
+}
+
+// WithUserEncoder replaces the JSON encoding of users sent by CreateUser,
+// CreateUsers and Upsert. The encoder is called without the user's lock held.
+func WithUserEncoder(encode func(*User) ([]byte, error)) Option {
+	return func(um *UserManager) {
+		um.userEncoder = encode
+	}
+}
+
+// WithMetadataSerializer replaces the JSON encoding of user metadata in
+// request bodies sent by CreateUser, CreateUsers, Upsert and UpdateUser
+// (when the updates carry a "metadata" map), e.g. for custom value types the
+// server expects in another shape. It is called with the user's read lock
+// held and is not used when WithUserEncoder is set.
+func WithMetadataSerializer(serialize func(map[string]interface{}) (json.RawMessage, error)) Option {
+	return func(um *UserManager) {
+		um.metadataSerializer = serialize
+	}
+}
+
+// WithMetadataDeserializer converts the metadata of every user decoded from
+// a response, the counterpart of WithMetadataSerializer. It receives the
+// metadata object exactly as the server sent it (re-encoded as JSON for
+// users from a WithUserDecoder) and its result replaces Metadata before any
+// WithUserTransformer runs.
+func WithMetadataDeserializer(deserialize func(json.RawMessage) (map[string]interface{}, error)) Option {
+	return func(um *UserManager) {
+		um.metadataDeserializer = deserialize
+	}
+}
+
+// WithMetadataFetch controls whether FetchUser, GetUsersByStatus and
+// QueryUsers ask for user metadata. Disabled, they request only the other
+// fields with a "fields" query parameter, for lighter payloads in views that
+// don't need metadata, and every user decoded from a response starts out
+// with empty metadata, which only a WithUserTransformer may fill. The
+// default is enabled.
+func WithMetadataFetch(enabled bool) Option {
+	return func(um *UserManager) {
+		um.skipMetadata = !enabled
+	}
+}
+
+// WithUserTransformer normalizes every user decoded from a response, e.g.
+// lowercasing emails, before it is cached or returned. The transformer may
+// modify the user or return a replacement; returning nil keeps the user as
+// decoded. It applies to single-user responses and to listings.
+func WithUserTransformer(transform func(*User) *User) Option {
+	return func(um *UserManager) {
+		um.userTransformer = transform
+	}
+}
+
+// WithJSONNumberMode makes JSON responses decode numbers inside metadata as
+// json.Number instead of float64, so large integers such as external IDs keep
+// their precision. It is off by default.
+func WithJSONNumberMode(enabled bool) Option {
+	return func(um *UserManager) {
+		um.useNumber = enabled
+	}
+}
+
+// WithContextLogger adds request-scoped fields, such as a tenant or trace ID
+// carried in the context, to the manager's log lines for each operation.
+// fields returns alternating keys and values, which are appended to the
+// message as key=value pairs. A nil fields function adds nothing.
+func WithContextLogger(fields func(ctx context.Context) []interface{}) Option {
+	return func(um *UserManager) {
+		um.logFields = fields
+	}
+}
+
+// WithHTTPTrace logs the DNS, connect, TLS and time-to-first-byte timings of
+// every request when enabled, to diagnose slow upstreams and connection reuse
+func WithHTTPTrace(enabled bool) Option {
+	return func(um *UserManager) {
+		um.httpTrace = enabled
+	}
+}
+
+// WithRetryPredicate replaces the default retry rules with a custom
+// decision. It receives the response (with a body that can be read freely)
+// or the transport error of every attempt, successful statuses included, so
+// it can retry on a body-level signal such as {"success":false,"error":"busy"}
+// on a 200. It must return false for the responses it accepts. The retry
+// budget from maxRetries still applies.
+func WithRetryPredicate(retry func(resp *http.Response, err error) bool) Option {
+	return func(um *UserManager) {
+		um.retryPredicate = retry
+	}
+}
+
+// WithRetryableStatusCodes replaces the status codes retried by default (429
+// and 5xx) with codes, e.g. to also retry 409 or 425. Network errors are
+// still retried and only idempotent methods are retried at all. Codes below
+// 400, which are never retried, and invalid codes are ignored.
+// WithRetryPredicate takes precedence.
+func WithRetryableStatusCodes(codes ...int) Option {
+	return func(um *UserManager) {
+		statuses := make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < 400 || code > 599 {
+				log.Printf("Ignoring invalid retryable status code: %d", code)
+				continue
+			}
+			statuses[code] = true
+		}
+		um.retryStatuses = statuses
+	}
+}
+
+// WithMaxRetriesPerStatus overrides the retry budget for responses with the
+// given statuses, e.g. {503: 5, 429: 2}: a request whose latest attempt got
+// one of them is retried until it has been retried that many times in total.
+// Other statuses and network errors keep the default budget. It only limits
+// retries the retry rules allow; negative budgets are ignored.
+func WithMaxRetriesPerStatus(budgets map[int]int) Option {
+	return func(um *UserManager) {
+		um.statusRetries = make(map[int]int, len(budgets))
+		for status, retries := range budgets {
+			if retries < 0 {
+				log.Printf("Ignoring negative retry budget for status %d: %d", status, retries)
+				continue
+			}
+			um.statusRetries[status] = retries
+		}
+	}
+}
+
+// WithBeforeRequest registers a hook called with every outgoing request
+// before it is sent, e.g. to add a signature header. Changes it makes are
+// kept for retries. Returning an error aborts the operation, which fails
+// like a request that could not be sent.
+func WithBeforeRequest(hook func(*http.Request) error) Option {
+	return func(um *UserManager) {
+		um.beforeRequest = hook
+	}
+}
+
+// WithAfterResponse registers a hook called with every final response, after
+// any retries and before the operation reads it. Returning an error aborts
+// the operation, which fails like a request that could not be sent.
+func WithAfterResponse(hook func(*http.Response) error) Option {
+	return func(um *UserManager) {
+		um.afterResponse = hook
+	}
+}
+
+// WithErrorClassifier translates error responses of FetchUser and
+// UpdateUser into domain errors, e.g. 410 into ErrUserNotFound. It receives
+// the status code and body of every response with a 4xx or 5xx status; when
+// it returns nil the default mapping to ErrUserNotFound or ErrAPIError applies.
+func WithErrorClassifier(classify func(status int, body []byte) error) Option {
+	return func(um *UserManager) {
+		um.errorClassifier = classify
+	}
+}
+
+// WithWeightedConcurrency caps concurrent requests across all operations
+// with a shared budget of total units. Single calls such as FetchUser take one
+// unit per request and each request made by a batch operation takes
+// batchWeight. Single calls take free units ahead of queued batch requests,
+// so once a batch saturates the budget an interactive call waits for at most
+// one in-flight request to finish, never for the rest of the batch. Batch
+// requests are served in arrival order among themselves. By default single
+// calls are unbounded and each batch only limits its own concurrency.
+func WithWeightedConcurrency(total, batchWeight int64) Option {
+	return func(um *UserManager) {
+		if total < 1 || batchWeight < 1 || batchWeight > total {
+			log.Printf("Ignoring invalid weighted concurrency: total %d, batch weight %d", total, batchWeight)
+			return
+		}
+		um.limiter = newWeightedSemaphore(total)
+		um.batchWeight = batchWeight
+	}
+}
+
+// WithPanicRecovery makes batch operations recover from panics in the work
+// for a single user, including hooks and callbacks such as a user
+// transformer or progress function. The panic is logged with its stack
+// trace and reported as that user's error instead of crashing the process.
+func WithPanicRecovery() Option {
+	return func(um *UserManager) {
+		um.recoverPanics = true
+	}
+}
+
+// WithMissingDeleteOK makes BatchDeleteUsers report users that are already
+// gone (404) as successfully deleted instead of with ErrUserNotFound
+func WithMissingDeleteOK(enabled bool) Option {
+	return func(um *UserManager) {
+		um.deleteMissingOK = enabled
+	}
+}
+
+// WithRawResponseCapture keeps the raw responses of the last n user fetches,
+// available from LastRawResponses, to help reproduce decoding problems.
+// Bodies are capped at MaxRawResponseBody bytes. It is disabled by default.
+func WithRawResponseCapture(n int) Option {
+	return func(um *UserManager) {
+		if n < 0 {
+			log.Printf("Ignoring negative raw response capture size: %d", n)
+			return
+		}
+		um.rawCap = n
+		um.rawResponses = make([]RawResponse, 0, n)
+	}
+}
+
+// WithDryRun makes write requests (anything but GET and HEAD) be recorded in
+// DryRunLog instead of sent. Each is answered locally with a success
+// response echoing the request body, so CreateUser, UpdateUser, DeleteUser,
+// Upsert and the batch operations report success without touching the
+// server or the user and query caches. Reads still go out.
+func WithDryRun(enabled bool) Option {
+	return func(um *UserManager) {
+		um.dryRun = enabled
+	}
+}
+
+// WithRequestBodyLogging logs the JSON body of every write request before it
+// is sent, truncated to maxLoggedBody bytes. Values of the given metadata
+// keys are replaced with RedactedValue wherever a "metadata" object appears
+// in the body. Bodies may carry personal data, so this is off by default.
+func WithRequestBodyLogging(redactMetadataKeys ...string) Option {
+	return func(um *UserManager) {
+		um.logBodies = true
+		um.logRedacts = append([]string(nil), redactMetadataKeys...)
+	}
+}
+
+// WithLatencyBudget flags successful requests that take longer than budget,
+// retries included: each is logged and counted in
+// ManagerMetrics.SlowResponses. If reportAsError is set, FetchUser,
+// FetchUserFresh, QueryUsers and GetUsersByStatus also return a
+// *SlowResponseError alongside their normal result, which is still returned.
+func WithLatencyBudget(budget time.Duration, reportAsError bool) Option {
+	return func(um *UserManager) {
+		if budget <= 0 {
+			log.Printf("Ignoring non-positive latency budget: %v", budget)
+			return
+		}
+		um.latencyBudget = budget
+		um.slowAsError = reportAsError
+	}
+}
+
+// WithServerTimeOffset sets how far the server's clock is ahead of ours
+// (negative if behind), for ServerNow and the manager's DaysActive and
+// IsExpired. SyncServerTime measures and replaces it.
+func WithServerTimeOffset(offset time.Duration) Option {
+	return func(um *UserManager) {
+		um.serverOffset.Store(int64(offset))
+	}
+}
+
+// WithMinRequestTime makes FetchUser and UpdateUser fail immediately with
+// context.DeadlineExceeded, without sending anything, when their context's
+// deadline leaves less than d for the request. Cache hits are still served.
+// By default requests are attempted however little time remains.
+func WithMinRequestTime(d time.Duration) Option {
+	return func(um *UserManager) {
+		if d <= 0 {
+			log.Printf("Ignoring non-positive minimum request time: %v", d)
+			return
+		}
+		um.minRequestTime = d
+	}
+}
+
+// WithMaxResults makes ListAllUsers stop after yielding n users, ending
+// with ErrResultLimitExceeded if there are more, as a guard against runaway
+// pagination and accidental full scans. By default there is no limit.
+func WithMaxResults(n int) Option {
+	return func(um *UserManager) {
+		if n <= 0 {
+			log.Printf("Ignoring non-positive result limit: %d", n)
+			return
+		}
+		um.maxResults = n
+	}
+}
+
+// WithMaxPages makes ListAllUsers stop after fetching n pages, ending with
+// ErrResultLimitExceeded if the server reports more, as a guard against
+// pagination that never ends. By default there is no limit.
+func WithMaxPages(n int) Option {
+	return func(um *UserManager) {
+		if n <= 0 {
+			log.Printf("Ignoring non-positive page limit: %d", n)
+			return
+		}
+		um.maxPages = n
+	}
+}
+
+// DefaultDeadlineHeader is the header WithDeadlineHeader uses by default
+const DefaultDeadlineHeader = "X-Request-Timeout"
+
+// WithDeadlineHeader sends the time left before the request context's
+// deadline, in whole milliseconds, in the named header (or
+// DefaultDeadlineHeader if header is empty) of every attempt, so a
+// cooperating server can abandon work the client won't wait for. Requests
+// whose context has no deadline are sent without it.
+func WithDeadlineHeader(header string) Option {
+	return func(um *UserManager) {
+		if header == "" {
+			header = DefaultDeadlineHeader
+		}
+		um.deadlineHeader = http.CanonicalHeaderKey(header)
+	}
+}
+
+// NewUserManager creates a new user manager
+func NewUserManager(baseURL string, opts ...Option) *UserManager {
+	um := &UserManager{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: TimeoutSeconds * time.Second,
+		},
+		timeout:    TimeoutSeconds * time.Second,
+		maxRetries: MaxRetries,
+		headers:    make(http.Header),
+		timeFormat: time.RFC3339,
+
+		defaultStatus: StatusActive,
+		clock:         realClock{},
+		baseCtx:       context.Background(),
+	}
+
+	for _, opt := range opts {
+		opt(um)
+	}
+
+	um.metrics.since.Store(time.Now().UnixNano())
+	um.baseCtx, um.cancelBase = context.WithCancel(um.baseCtx)
+	um.background, um.stopBackground = context.WithCancel(um.baseCtx)
+
+	configured := len(um.transportOpts) > 0 || um.connectTimeout > 0
+	switch {
+	case um.customClient:
+		if configured || um.sharedTransport {
+			log.Printf("Transport options ignored: a custom HTTP client was provided")
+		}
+	case um.sharedTransport:
+		if configured {
+			log.Printf("Transport options ignored: the shared transport is in use")
+		}
+		um.client.Transport = SharedTransport()
+	case configured:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		for _, configure := range um.transportOpts {
+			configure(transport)
+		}
+		if um.connectTimeout > 0 {
+			transport.DialContext = dialTimeout(transport.DialContext, um.connectTimeout)
+		}
+		um.client.Transport = transport
+	}
+
+	return um
+}
+
+// dialTimeout wraps dial so each connection attempt is abandoned after d. A
+// nil dial stands for a default net.Dialer.
+func dialTimeout(dial func(ctx context.Context, network, addr string) (net.Conn, error), d time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// headersKey is the context key for request-scoped headers
+type headersKey struct{}
+
+// WithHeaders returns a context carrying headers that are added to every
+// request the manager makes with it. Multiple calls merge, with later
+// values replacing earlier ones for the same header.
+func WithHeaders(ctx context.Context, h http.Header) context.Context {
+	merged := make(http.Header)
+	if existing, ok := ctx.Value(headersKey{}).(http.Header); ok {
+		for key, values := range existing {
+			merged[key] = append([]string(nil), values...)
+		}
+	}
+	for key, values := range h {
+		merged[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return context.WithValue(ctx, headersKey{}, merged)
+}
+
+// HeadersFromContext returns the headers stored in ctx by WithHeaders
+func HeadersFromContext(ctx context.Context) http.Header {
+	h, _ := ctx.Value(headersKey{}).(http.Header)
+	return h
+}
+
+// logf logs like log.Printf, followed by the fields WithContextLogger
+// extracts from ctx
+func (um *UserManager) logf(ctx context.Context, format string, args ...interface{}) {
+	if um.logFields == nil {
+		log.Printf(format, args...)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, format, args...)
+	fields := um.logFields(ctx)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fmt.Fprintf(&b, " !BADKEY=%v", fields[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+	}
+	log.Print(b.String())
+}
+
+// newRequest builds an outbound request. Headers are applied in increasing
+// order of precedence: the package defaults (Content-Type, Accept,
+// User-Agent), then the headers from WithHeaders in ctx, then the headers
+// configured on the manager through options. Context headers can therefore
+// never replace manager-level headers such as Authorization.
+func (um *UserManager) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Go-UserManager/1.0")
+
+	if um.logBodies && body != nil && method != http.MethodGet && method != http.MethodHead {
+		um.logf(ctx, "%s %s body: %s", method, url, um.loggedBody(body))
+	}
+
+	for key, values := range HeadersFromContext(ctx) {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	for key, values := range um.headers {
+		req.Header[key] = append([]string(nil), values...)
+	}
+
+	return req, nil
+}
+
+// checkDeadline returns context.DeadlineExceeded if ctx's deadline leaves
+// less than the WithMinRequestTime minimum for a request
+func (um *UserManager) checkDeadline(ctx context.Context) error {
+	if um.minRequestTime <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < um.minRequestTime {
+		um.logf(ctx, "Skipping request: %v left before the deadline", time.Until(deadline))
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// CacheObserver is notified of cache operations, e.g. to feed telemetry or
+// a secondary cache. Methods are called synchronously on the request path
+// and must return quickly.
+type CacheObserver interface {
+	OnHit(userID string)
+	OnMiss(userID string)
+	OnStore(userID string)
+	OnEvict(userID string)
+}
+
+// do sends req with its context additionally bound to the manager's base
+// context, so cancelling either aborts the request, retrying failed attempts
+// up to maxRetries times with exponential backoff. The binding is released
+// when the response body is closed.
+func (um *UserManager) do(req *http.Request) (*http.Response, error) {
+	if um.dryRun && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return um.dryRunResponse(req)
+	}
+
+	if um.beforeRequest != nil {
+		if err := um.beforeRequest(req); err != nil {
+			return nil, fmt.Errorf("before request hook: %w", err)
+		}
+	}
+
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(um.baseCtx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	if um.limiter != nil {
+		weight, priority := int64(1), true
+		if isBatchOp(req.Context()) {
+			weight, priority = um.batchWeight, false
+		}
+		if err := um.limiter.Acquire(ctx, weight, priority); err != nil {
+			release()
+			return nil, err
+		}
+		release = func() {
+			stop()
+			cancel()
+			um.limiter.Release(weight)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req.WithContext(ctx)
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				release()
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			attemptReq.Body = body
+		}
+		if um.deadlineHeader != "" {
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > 0 {
+				attemptReq.Header.Set(um.deadlineHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+			}
+		}
+
+		resp, err := um.send(attemptReq)
+		budget := um.retryBudget(resp)
+		if attempt >= budget || ctx.Err() != nil || !um.shouldRetry(req, resp, err) {
+			if err != nil {
+				release()
+				return nil, err
+			}
+			elapsed := time.Since(start)
+			if um.latencyBudget > 0 && elapsed > um.latencyBudget && resp.StatusCode < 400 {
+				um.metrics.slowResponses.Add(1)
+				um.logf(req.Context(), "Slow response: %s %s took %v, budget %v", req.Method, req.URL.Path, elapsed, um.latencyBudget)
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release, elapsed: elapsed}
+			if um.afterResponse != nil {
+				if err := um.afterResponse(resp); err != nil {
+					resp.Body.Close()
+					return nil, fmt.Errorf("after response hook: %w", err)
+				}
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			um.logf(req.Context(), "Retrying %s %s after status %d (attempt %d of %d)", req.Method, req.URL.Path, resp.StatusCode, attempt+1, budget)
+		} else {
+			um.logf(req.Context(), "Retrying %s %s after error: %v (attempt %d of %d)", req.Method, req.URL.Path, err, attempt+1, budget)
+		}
+
+		timer := time.NewTimer(retryBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send performs a single attempt of req, recording metrics and, when
+// enabled, the HTTP trace
+func (um *UserManager) send(req *http.Request) (*http.Response, error) {
+	var timings *requestTimings
+	if um.httpTrace {
+		timings = &requestTimings{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.clientTrace()))
+	}
+
+	start := time.Now()
+	resp, err := um.client.Do(req)
+	if timings != nil {
+		timings.log(um, req, start)
+	}
+	um.metrics.requests.Add(1)
+	um.metrics.totalLatency.Add(int64(time.Since(start)))
+	if err != nil {
+		um.metrics.networkErrors.Add(1)
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		um.metrics.statusErrors.Add(1)
+	}
+	um.recordRateLimit(resp.Header)
+	return resp, nil
+}
+
+// RetryBaseDelay is the backoff before the first retry; it doubles with each
+// further attempt up to RetryMaxDelay
+const (
+	RetryBaseDelay = 100 * time.Millisecond
+	RetryMaxDelay  = 2 * time.Second
+)
+
+// retryBackoff returns the jittered delay before retry number attempt+1
+func retryBackoff(attempt int) time.Duration {
+	delay := RetryBaseDelay << attempt
+	if delay <= 0 || delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	return jitter(delay, 0.2)
+}
+
+// retryBudget returns how many retries a request whose latest attempt got
+// resp (nil after a network error) may use in total
+func (um *UserManager) retryBudget(resp *http.Response) int {
+	if resp != nil {
+		if retries, ok := um.statusRetries[resp.StatusCode]; ok {
+			return retries
+		}
+	}
+	return um.maxRetries
+}
+
+// shouldRetry decides whether an attempt is retried. A predicate set with
+// WithRetryPredicate decides on its own for every attempt, seeing the
+// response with its body buffered and restored afterwards, so reading it
+// there doesn't consume it.
+// Otherwise network errors and responses with a retryable status (429 and
+// 5xx unless set with WithRetryableStatusCodes) are retried for idempotent
+// methods only, and responses below 400 never are.
+func (um *UserManager) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if um.retryPredicate != nil {
+		if resp == nil {
+			return um.retryPredicate(nil, err)
+		}
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			// Leave the read error for whoever reads the body next
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{readErr}))
+			return false
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		retry := um.retryPredicate(resp, err)
+		// Restore the body the predicate may have read
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return retry
+	}
+
+	if err == nil && resp.StatusCode < 400 {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+	default:
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+	if um.retryStatuses != nil {
+		return um.retryStatuses[resp.StatusCode]
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// rateLimit is the rate-limit state last reported by the server
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// recordRateLimit stores the X-RateLimit-Remaining and X-RateLimit-Reset
+// headers of a response. X-RateLimit-Reset may be a unix timestamp or a
+// number of seconds from now. Responses without a valid
+// X-RateLimit-Remaining leave the last state unchanged.
+func (um *UserManager) recordRateLimit(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	limit := &rateLimit{remaining: remaining}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		// Values this large can only be epoch seconds, not a delay
+		if reset > 1_000_000_000 {
+			limit.reset = time.Unix(reset, 0)
+		} else {
+			limit.reset = time.Now().Add(time.Duration(reset) * time.Second)
+		}
+	}
+	um.rateLimit.Store(limit)
+}
+
+// LastRateLimit returns the remaining request budget and the time it resets,
+// as reported by the X-RateLimit-* headers of the most recent response that
+// carried them. remaining is -1 if no such response has been seen, and reset
+// is zero if the server did not send a reset time.
+func (um *UserManager) LastRateLimit() (remaining int, reset time.Time) {
+	limit := um.rateLimit.Load()
+	if limit == nil {
+		return -1, time.Time{}
+	}
+	return limit.remaining, limit.reset
+}
+
+// ServerNow returns the current time on the server's clock: the manager's
+// clock corrected by the offset from WithServerTimeOffset or SyncServerTime.
+// Only the manager's DaysActive and IsExpired use it; the package-level
+// helpers such as GetUserStatistics, StatisticsAccumulator, AgeCategoryValue
+// and FilterExpiredUsers go by the local clock.
+func (um *UserManager) ServerNow() time.Time {
+	return um.clock.Now().Add(time.Duration(um.serverOffset.Load()))
+}
+
+// DaysActive returns the number of days user has been active by the
+// server's clock, see ServerNow
+func (um *UserManager) DaysActive(user *User) int {
+	return user.DaysActiveAt(um.ServerNow())
+}
+
+// IsExpired reports whether user is expired by the server's clock, see
+// ServerNow
+func (um *UserManager) IsExpired(user *User) bool {
+	return user.IsExpiredAt(um.ServerNow())
+}
+
+// SyncServerTime measures the offset between the server's clock and ours
+// from the Date header of a HEAD request to the base URL, records it for
+// ServerNow and returns it. The server's status code doesn't matter, but a
+// response without a valid Date header is an error. Date headers have
+// one-second resolution, so the offset is only accurate to about a second.
+func (um *UserManager) SyncServerTime(ctx context.Context) (time.Duration, error) {
+	req, err := um.newRequest(ctx, http.MethodHead, um.baseURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := um.clock.Now()
+	resp, err := um.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	resp.Body.Close()
+	end := um.clock.Now()
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid Date header: %v", ErrAPIError, err)
+	}
+
+	// The header is truncated to the second and was stamped about halfway
+	// through the round trip
+	serverTime = serverTime.Add(500 * time.Millisecond)
+	offset := serverTime.Sub(start.Add(end.Sub(start) / 2))
+	um.serverOffset.Store(int64(offset))
+	um.logf(ctx, "Server clock offset: %v", offset)
+	return offset, nil
+}
+
+// maxClassifiedBody bounds how much of an error response is read for the
+// error classifier
+const maxClassifiedBody = 64 << 10
+
+// classifyError returns the error the configured classifier maps an error
+// response to, or nil if there is no classifier, the response is not an
+// error, or the classifier leaves it to the default mapping
+func (um *UserManager) classifyError(ctx context.Context, resp *http.Response) error {
+	if um.errorClassifier == nil || resp.StatusCode < 400 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxClassifiedBody))
+	if err != nil {
+		um.logf(ctx, "Failed to read error response for classification: %v", err)
+	}
+	return um.errorClassifier(resp.StatusCode, body)
+}
+
+// decode decodes the response body into v, counting failures. Malformed
+// bodies are reported with ErrDecodeResponse.
+func (um *UserManager) decode(resp *http.Response, v interface{}) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		um.metrics.decodeErrors.Add(1)
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	err = decodeResponse(resp.Header.Get("Content-Type"), bytes.NewReader(body), v, um.useNumber)
+	if err != nil {
+		um.metrics.decodeErrors.Add(1)
+		return decodeError(err, body)
+	}
+	return nil
+}
+
+// maxLoggedBody bounds how much of a request body WithRequestBodyLogging logs
+const maxLoggedBody = 2048
+
+// loggedBody renders a request body for WithRequestBodyLogging, redacting
+// the configured metadata keys. Bodies that aren't JSON are logged as is.
+func (um *UserManager) loggedBody(body []byte) string {
+	if len(um.logRedacts) > 0 {
+		var generic interface{}
+		if err := json.Unmarshal(body, &generic); err == nil {
+			um.redactMetadata(generic)
+			if redacted, err := json.Marshal(generic); err == nil {
+				body = redacted
+			}
+		}
+	}
+	if len(body) > maxLoggedBody {
+		return string(body[:maxLoggedBody]) + "..."
+	}
+	return string(body)
+}
+
+// redactMetadata replaces the values of the configured keys in every
+// "metadata" object nested in v
+func (um *UserManager) redactMetadata(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if metadata, ok := value.(map[string]interface{}); ok && key == "metadata" {
+				for _, redact := range um.logRedacts {
+					if _, ok := metadata[redact]; ok {
+						metadata[redact] = RedactedValue
+					}
+				}
+			}
+			um.redactMetadata(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			um.redactMetadata(value)
+		}
+	}
+}
+
+// maxBodySnippet bounds how much of a malformed body is quoted in errors
+const maxBodySnippet = 200
+
+// decodeError wraps a decoding failure in ErrDecodeResponse, quoting the
+// start of the offending body for debugging
+func decodeError(err error, body []byte) error {
+	snippet := string(body)
+	if len(body) > maxBodySnippet {
+		snippet = string(body[:maxBodySnippet]) + "..."
+	}
+	return fmt.Errorf("%w: %w (body: %q)", ErrDecodeResponse, err, snippet)
+}
+
+// checkSuccess inspects the optional envelope of a write response whose
+// data isn't needed. An explicit "success": false is reported like any other
+// unsuccessful ApiResponse; an empty body, a body that isn't an envelope or
+// an envelope without a success field counts as success. A body that cannot
+// be read in full is an error, since the write's outcome is unknown.
+func (um *UserManager) checkSuccess(resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	var envelope struct {
+		Success *bool   `json:"success" xml:"success"`
+		Error   *string `json:"error" xml:"error"`
+	}
+	if err := decodeResponse(resp.Header.Get("Content-Type"), bytes.NewReader(body), &envelope, false); err != nil {
+		return nil
+	}
+	if envelope.Success == nil || *envelope.Success {
+		return nil
+	}
+	return (&ApiResponse[struct{}]{Error: envelope.Error}).Err()
+}
+
+// decodeUser decodes a single user from a successful response, using the
+// configured user decoder or else the ApiResponse envelope. It returns a nil
+// user without error when the response carries no user.
+func (um *UserManager) decodeUser(resp *http.Response) (*User, error) {
+	var user *User
+	if um.userDecoder != nil {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			um.metrics.decodeErrors.Add(1)
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		user, err = um.userDecoder(bytes.NewReader(body))
+		if err != nil {
+			um.metrics.decodeErrors.Add(1)
+			return nil, fmt.Errorf("failed to decode response: %w", decodeError(err, body))
+		}
+	} else {
+		var apiResp ApiResponse[User]
+		if err := um.decode(resp, &apiResp); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		if err := apiResp.Err(); err != nil {
+			return nil, err
+		}
+		user = apiResp.Data
+	}
+
+	return um.prepareUser(user)
+}
+
+// prepareUser readies a decoded user for use: it initializes the metadata
+// and applies the configured metadata deserializer and transformer. With
+// WithMetadataFetch disabled, metadata the server sent anyway is dropped
+// before either runs. A nil user is returned as is.
+func (um *UserManager) prepareUser(user *User) (*User, error) {
+	if user == nil {
+		return nil, nil
+	}
+
+	raw := user.rawMetadata
+	user.rawMetadata = nil
+	var err error
+	switch {
+	case um.skipMetadata:
+		user.Metadata = nil
+	case um.metadataDeserializer != nil:
+		if raw == nil {
+			// Decoded by a custom user decoder, or not from JSON
+			raw, err = json.Marshal(user.Metadata)
+		}
+		if err == nil {
+			user.Metadata, err = um.metadataDeserializer(raw)
+		}
+	case um.useNumber && raw != nil:
+		// User.UnmarshalJSON can't see the decoder's UseNumber setting
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		user.Metadata = nil
+		err = decoder.Decode(&user.Metadata)
+	}
+	if err != nil {
+		um.metrics.decodeErrors.Add(1)
+		return nil, fmt.Errorf("%w: metadata of user %s: %w", ErrDecodeResponse, user.ID, err)
+	}
+	if user.Metadata == nil {
+		user.Metadata = make(map[string]interface{})
+	}
+	if um.userTransformer != nil {
+		if transformed := um.userTransformer(user); transformed != nil {
+			user = transformed
+			if user.Metadata == nil {
+				user.Metadata = make(map[string]interface{})
+			}
+		}
+	}
+	return user, nil
+}
+
+// userFields is the "fields" parameter sent when metadata isn't fetched
+const userFields = "id,name,email,status,created_at"
+
+// withUserFields adds the "fields" parameter to query if metadata isn't
+// fetched and returns query
+func (um *UserManager) withUserFields(query url.Values) url.Values {
+	if um.skipMetadata {
+		query.Set("fields", userFields)
+	}
+	return query
+}
+
+// encodeUser encodes a user for a request body, using the configured user
+// encoder or else plain JSON with the configured metadata serializer
+func (um *UserManager) encodeUser(user *User) ([]byte, error) {
+	if um.userEncoder != nil {
+		return um.userEncoder(user)
+	}
+	if um.metadataSerializer == nil {
+		return user.marshalJSON()
+	}
+
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+
+	metadata, err := um.metadataSerializer(user.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize metadata: %w", err)
+	}
+	return json.Marshal(struct {
+		ID        string          `json:"id"`
+		Name      string          `json:"name"`
+		Email     string          `json:"email"`
+		Status    UserStatus      `json:"status"`
+		CreatedAt time.Time       `json:"created_at"`
+		Metadata  json.RawMessage `json:"metadata"`
+	}{user.ID, user.Name, user.Email, user.Status, user.CreatedAt, metadata})
+}
+
+// decodeResponse decodes body into v according to the response's
+// Content-Type. JSON (including "+json" types) and XML (including "+xml"
+// types) are supported. A missing or text/plain Content-Type, which servers
+// that don't set one end up sending, is treated as JSON. useNumber decodes
+// JSON numbers held in interface{} values as json.Number.
+func decodeResponse(contentType string, body io.Reader, v interface{}, useNumber bool) error {
+	decodeJSON := func() error {
+		decoder := json.NewDecoder(body)
+		if useNumber {
+			decoder.UseNumber()
+		}
+		return decoder.Decode(v)
+	}
+
+	if contentType == "" {
+		return decodeJSON()
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid response content type %q: %w", contentType, err)
+	}
+
+	switch {
+	case mediaType == "application/json" || mediaType == "text/plain" || strings.HasSuffix(mediaType, "+json"):
+		return decodeJSON()
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return xml.NewDecoder(body).Decode(v)
+	default:
+		return fmt.Errorf("unsupported response content type %q", mediaType)
+	}
+}
+
+// requestTimings collects the phase timestamps of a traced request
+type requestTimings struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+// clientTrace returns the hooks that record the request phases
+func (t *requestTimings) clientTrace() *httptrace.ClientTrace {
+	record := func(field *time.Time) {
+		t.mu.Lock()
+		*field = time.Now()
+		t.mu.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { record(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { record(&t.dnsDone) },
+		ConnectStart:         func(string, string) { record(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { record(&t.connectDone) },
+		TLSHandshakeStart:    func() { record(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&t.tlsDone) },
+		GotFirstResponseByte: func() { record(&t.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+	}
+}
+
+// log writes the recorded phase durations for req through um's logger
+func (t *requestTimings) log(um *UserManager, req *http.Request, start time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	phase := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from)
+	}
+
+	um.logf(req.Context(), "HTTP trace %s %s: dns=%v connect=%v tls=%v first_byte=%v reused=%t",
+		req.Method, req.URL.Path,
+		phase(t.dnsStart, t.dnsDone),
+		phase(t.connectStart, t.connectDone),
+		phase(t.tlsStart, t.tlsDone),
+		phase(start, t.firstByte),
+		t.reused)
+}
+
+// dryRunHeader marks responses synthesized in dry-run mode
+const dryRunHeader = "X-Dry-Run"
+
+// DryRunEntry is a write request recorded instead of sent in dry-run mode
+type DryRunEntry struct {
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	Body   string    `json:"body,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// DryRunLog returns the write requests recorded in dry-run mode, oldest first
+func (um *UserManager) DryRunLog() []DryRunEntry {
+	um.dryRunMu.Lock()
+	defer um.dryRunMu.Unlock()
+	return slices.Clone(um.dryRunLog)
+}
+
+// dryRunResponse records req and returns the synthetic success response
+// standing in for it, with the request body as data if it is JSON
+func (um *UserManager) dryRunResponse(req *http.Request) (*http.Response, error) {
+	req, body, err := readRequestBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	um.dryRunMu.Lock()
+	um.dryRunLog = append(um.dryRunLog, DryRunEntry{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Body:   string(body),
+		Time:   time.Now().UTC(),
+	})
+	um.dryRunMu.Unlock()
+	um.logf(req.Context(), "Dry run: %s %s not sent", req.Method, req.URL)
+
+	envelope := struct {
+		Success   bool            `json:"success"`
+		Data      json.RawMessage `json:"data,omitempty"`
+		Timestamp time.Time       `json:"timestamp"`
+	}{Success: true, Timestamp: time.Now().UTC()}
+	if json.Valid(body) {
+		envelope.Data = body
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set(dryRunHeader, "true")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+// isDryRun reports whether resp was synthesized in dry-run mode
+func isDryRun(resp *http.Response) bool {
+	return resp.Header.Get(dryRunHeader) == "true"
+}
+
+// SlowResponseError reports a successful request that exceeded the latency
+// budget set with WithLatencyBudget. It is returned together with the data.
+type SlowResponseError struct {
+	Method  string
+	URL     string
+	Elapsed time.Duration
+	Budget  time.Duration
+}
+
+// Error implements the error interface
+func (e *SlowResponseError) Error() string {
+	return fmt.Sprintf("slow response: %s %s took %v, budget %v", e.Method, e.URL, e.Elapsed, e.Budget)
+}
+
+// isSlowResponse reports whether err is only a latency warning
+func isSlowResponse(err error) bool {
+	var slow *SlowResponseError
+	return errors.As(err, &slow)
+}
+
+// slowResponse returns the latency warning for resp, or nil if warnings are
+// disabled or the response was within budget
+func (um *UserManager) slowResponse(resp *http.Response) error {
+	if !um.slowAsError || resp.StatusCode >= 400 {
+		return nil
+	}
+	body, ok := resp.Body.(*releasingBody)
+	if !ok || body.elapsed <= um.latencyBudget {
+		return nil
+	}
+	return &SlowResponseError{
+		Method:  resp.Request.Method,
+		URL:     resp.Request.URL.String(),
+		Elapsed: body.elapsed,
+		Budget:  um.latencyBudget,
+	}
+}
+
+// MaxRawResponseBody caps the body size kept per captured raw response
+const MaxRawResponseBody = 64 << 10
+
+// RawResponse is a user fetch response captured by WithRawResponseCapture
+type RawResponse struct {
+	UserID     string    `json:"user_id"`
+	StatusCode int       `json:"status_code"`
+	Body       []byte    `json:"body"`
+	Truncated  bool      `json:"truncated"`
+	Time       time.Time `json:"time"`
+}
+
+// LastRawResponses returns the captured raw responses, oldest first
+func (um *UserManager) LastRawResponses() []RawResponse {
+	um.rawMu.Lock()
+	defer um.rawMu.Unlock()
+
+	if len(um.rawResponses) < um.rawCap {
+		return slices.Clone(um.rawResponses)
+	}
+	return slices.Concat(um.rawResponses[um.rawNext:], um.rawResponses[:um.rawNext])
+}
+
+// captureRawResponse records the response to a fetch of userID when capture
+// is enabled. The body is read in full and replaced with an in-memory copy,
+// so it can still be decoded afterwards.
+func (um *UserManager) captureRawResponse(userID string, resp *http.Response) {
+	if um.rawCap == 0 {
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	var rest io.Reader = bytes.NewReader(body)
+	if err != nil {
+		rest = io.MultiReader(rest, errReader{err})
+	}
+	resp.Body = io.NopCloser(rest)
+
+	raw := RawResponse{
+		UserID:     userID,
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		Time:       um.clock.Now().UTC(),
+	}
+	if len(body) > MaxRawResponseBody {
+		raw.Body = body[:MaxRawResponseBody]
+		raw.Truncated = true
+	}
+	raw.Body = bytes.Clone(raw.Body)
+
+	um.rawMu.Lock()
+	defer um.rawMu.Unlock()
+	if len(um.rawResponses) < um.rawCap {
+		um.rawResponses = append(um.rawResponses, raw)
+		return
+	}
+	um.rawResponses[um.rawNext] = raw
+	um.rawNext = (um.rawNext + 1) % len(um.rawResponses)
+}
+
+// errReader is a reader that always fails with err
+type errReader struct {
+	err error
+}
+
+// Read implements the io.Reader interface
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// batchOpKey is the context key marking requests made by batch operations
+type batchOpKey struct{}
+
+// withBatchOp marks ctx as belonging to a batch operation, so its requests
+// take the batch weight under WithWeightedConcurrency
+func withBatchOp(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchOpKey{}, true)
+}
+
+// isBatchOp reports whether ctx was marked by withBatchOp
+func isBatchOp(ctx context.Context) bool {
+	batch, _ := ctx.Value(batchOpKey{}).(bool)
+	return batch
+}
+
+// weightedSemaphore is a counting semaphore whose acquisitions may take
+// several units. Priority waiters are granted ahead of ordinary ones, and
+// each kind in FIFO order, so a heavy ordinary waiter at the front blocks
+// lighter ordinary ones behind it rather than being starved by them, but
+// never a priority one. golang.org/x/sync/semaphore is strictly FIFO and
+// cannot express the priority class.
+type weightedSemaphore struct {
+	mu      sync.Mutex
+	size    int64
+	cur     int64
+	waiters []*semaphoreWaiter
+}
+
+// semaphoreWaiter is a pending acquisition
+type semaphoreWaiter struct {
+	n        int64
+	priority bool
+	ready    chan struct{}
+}
+
+// newWeightedSemaphore creates a semaphore with size units
+func newWeightedSemaphore(size int64) *weightedSemaphore {
+	return &weightedSemaphore{size: size}
+}
+
+// Acquire takes n units, blocking until they are available or ctx is done.
+// A priority acquisition only waits for units and other priority waiters;
+// an ordinary one also waits for every waiter queued before it.
+func (s *weightedSemaphore) Acquire(ctx context.Context, n int64, priority bool) error {
+	s.mu.Lock()
+	// Priority waiters are queued ahead of ordinary ones
+	ahead := slices.IndexFunc(s.waiters, func(w *semaphoreWaiter) bool {
+		return !w.priority
+	})
+	if ahead < 0 || !priority {
+		ahead = len(s.waiters)
+	}
+	if s.cur+n <= s.size && ahead == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+
+	w := &semaphoreWaiter{n: n, priority: priority, ready: make(chan struct{})}
+	s.waiters = slices.Insert(s.waiters, ahead, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted while giving up, so hand the units back
+			s.cur -= n
+		default:
+			s.waiters = slices.DeleteFunc(s.waiters, func(other *semaphoreWaiter) bool {
+				return other == w
+			})
+		}
+		s.notifyWaiters()
+		return ctx.Err()
+	}
+}
+
+// Release returns n units
+func (s *weightedSemaphore) Release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	s.notifyWaiters()
+}
+
+// notifyWaiters grants queued acquisitions in order while they fit. The
+// caller must hold s.mu.
+func (s *weightedSemaphore) notifyWaiters() {
+	for len(s.waiters) > 0 {
+		w := s.waiters[0]
+		if s.cur+w.n > s.size {
+			return
+		}
+		s.cur += w.n
+		s.waiters = s.waiters[1:]
+		close(w.ready)
+	}
+}
+
+// releasingBody runs release once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+	elapsed time.Duration // time taken by do, retries included
+}
+
+// Close implements the io.Closer interface
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock backed by time.Now
+type realClock struct{}
+
+// Now implements the Clock interface
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock that only moves when told to, for tests
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements the Clock interface
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to now
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// cacheEntry is a cached user together with its bookkeeping
+type cacheEntry struct {
+	user         *User
+	storedAt     time.Time
+	lastModified time.Time    // best-known modification time, for If-Modified-Since
+	expiresAt    time.Time    // zero if the entry never expires
+	accessedAt   atomic.Int64 // unix nanoseconds of the last read or store
+}
+
+// expired reports whether the entry's TTL has passed at now
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// tooOld reports whether the entry is older than maxAge at now; a zero
+// maxAge means no limit
+func (e *cacheEntry) tooOld(now time.Time, maxAge time.Duration) bool {
+	return maxAge > 0 && now.Sub(e.storedAt) > maxAge
+}
+
+// UpdatedAtMetadataKey is the metadata key holding a user's last
+// modification time, used when the server sends no Last-Modified header
+const UpdatedAtMetadataKey = "updated_at"
+
+// contextCacheKey is the context key for a request-scoped user cache
+type contextCacheKey struct{}
+
+// contextCache is the request-scoped cache stored by WithContextCache
+type contextCache struct {
+	users   sync.Map
+	queries sync.Map
+}
+
+// WithContextCache returns a context carrying its own empty user cache.
+// Manager calls made with the returned context (or contexts derived from it)
+// read and write that cache, and a query cache of their own, instead of the
+// manager's shared caches, so each request or tenant gets an isolated cache
+// that lives as long as the context is in use. Calls with a context without
+// a cache use the manager's caches.
+func WithContextCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextCacheKey{}, new(contextCache))
+}
+
+// cacheFor returns the cache stored in ctx, falling back to the manager's
+func (um *UserManager) cacheFor(ctx context.Context) *sync.Map {
+	if cache, ok := ctx.Value(contextCacheKey{}).(*contextCache); ok {
+		return &cache.users
+	}
+	return &um.cache
+}
+
+// queryCacheFor returns the query cache stored in ctx, falling back to the
+// manager's
+func (um *UserManager) queryCacheFor(ctx context.Context) *sync.Map {
+	if cache, ok := ctx.Value(contextCacheKey{}).(*contextCache); ok {
+		return &cache.queries
+	}
+	return &um.queryCache
+}
+
+// cacheKey returns the cache key for userID
+func (um *UserManager) cacheKey(userID string) string {
+	return um.cacheKeyPrefix + userID
+}
+
+// userIDFromKey returns the user ID of a cache key, or false if the key
+// belongs to another prefix
+func (um *UserManager) userIDFromKey(key interface{}) (string, bool) {
+	return strings.CutPrefix(key.(string), um.cacheKeyPrefix)
+}
+
+// cachePeek returns the cached entry for userID, expired or not, without
+// counting it as an access
+func (um *UserManager) cachePeek(ctx context.Context, userID string) (*cacheEntry, bool) {
+	value, ok := um.cacheFor(ctx).Load(um.cacheKey(userID))
+	if !ok {
+		return nil, false
+	}
+	return value.(*cacheEntry), true
+}
+
+// cacheLoad returns the unexpired cached entry for userID and marks it as
+// accessed. Expired entries count as misses but stay cached, so the next
+// fetch can revalidate them.
+func (um *UserManager) cacheLoad(ctx context.Context, userID string) (*cacheEntry, bool) {
+	entry, ok := um.cachePeek(ctx, userID)
+	if !ok || entry.expired(um.clock.Now()) || entry.tooOld(um.clock.Now(), um.cacheMaxAge) {
+		um.metrics.cacheMisses.Add(1)
+		if um.observer != nil {
+			um.observer.OnMiss(userID)
+		}
+		return nil, false
+	}
+	entry.accessedAt.Store(um.clock.Now().UnixNano())
+	um.metrics.cacheHits.Add(1)
+	if um.observer != nil {
+		um.observer.OnHit(userID)
+	}
+	return entry, true
+}
+
+// cacheStore caches user under userID, keeping the access time of any
+// entry it replaces so refreshes don't count as reads
+func (um *UserManager) cacheStore(ctx context.Context, userID string, user *User) {
+	um.cacheStoreModified(ctx, userID, user, time.Time{})
+}
+
+// cacheStoreModified is cacheStore with a known modification time. A zero
+// lastModified falls back to the user's updated_at metadata or CreatedAt.
+func (um *UserManager) cacheStoreModified(ctx context.Context, userID string, user *User, lastModified time.Time) {
+	if len(um.uncachedStatuses) > 0 {
+		user.mu.RLock()
+		status := user.Status
+		user.mu.RUnlock()
+		if um.uncachedStatuses[status] {
+			// Drop any older copy so it can't be served in place of this one
+			um.cacheDelete(ctx, userID)
+			return
+		}
+	}
+
+	if lastModified.IsZero() {
+		lastModified = user.modifiedAt()
+	}
+
+	now := um.clock.Now()
+	entry := &cacheEntry{user: user, storedAt: now, lastModified: lastModified}
+	if um.cacheTTL > 0 {
+		entry.expiresAt = now.Add(jitter(um.cacheTTL, um.ttlJitter))
+	}
+	entry.accessedAt.Store(now.UnixNano())
+	if previous, loaded := um.cacheFor(ctx).Swap(um.cacheKey(userID), entry); loaded {
+		entry.accessedAt.Store(previous.(*cacheEntry).accessedAt.Load())
+	}
+	if um.observer != nil {
+		um.observer.OnStore(userID)
+	}
+}
+
+// cacheDelete evicts userID from the cache
+func (um *UserManager) cacheDelete(ctx context.Context, userID string) {
+	if _, loaded := um.cacheFor(ctx).LoadAndDelete(um.cacheKey(userID)); loaded {
+		um.recordEvict(userID)
+	}
+}
+
+// queryCacheEntry is a cached query result
+type queryCacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// queryKey returns the query cache key for a query URL made with ctx. The
+// headers from WithHeaders are part of the key, since they can change what
+// the server returns, e.g. a tenant header.
+func queryKey(ctx context.Context, query string) string {
+	headers := HeadersFromContext(ctx)
+	if len(headers) == 0 {
+		return query
+	}
+
+	var b strings.Builder
+	b.WriteString(query)
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		for _, value := range headers[name] {
+			fmt.Fprintf(&b, "\n%s: %s", name, value)
+		}
+	}
+	return b.String()
+}
+
+// queryCacheLoad returns the unexpired cached result for a query URL in the
+// query cache for ctx
+func (um *UserManager) queryCacheLoad(ctx context.Context, query string) (interface{}, bool) {
+	if um.queryTTL <= 0 {
+		return nil, false
+	}
+	cache, key := um.queryCacheFor(ctx), queryKey(ctx, query)
+	value, ok := cache.Load(key)
+	if !ok {
+		return nil, false
+	}
+	entry := value.(*queryCacheEntry)
+	if um.clock.Now().After(entry.expiresAt) {
+		cache.CompareAndDelete(key, entry)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// queryCacheStore caches the result for a query URL in the query cache for
+// ctx
+func (um *UserManager) queryCacheStore(ctx context.Context, query string, value interface{}) {
+	if um.queryTTL <= 0 {
+		return
+	}
+	um.queryCacheFor(ctx).Store(queryKey(ctx, query), &queryCacheEntry{value: value, expiresAt: um.clock.Now().Add(um.queryTTL)})
+}
+
+// invalidateQueries drops every cached query result after a write: those
+// in the manager's query cache and in the one carried by ctx, if any
+func (um *UserManager) invalidateQueries(ctx context.Context) {
+	um.queryCache.Clear()
+	um.queryCacheFor(ctx).Clear()
+}
+
+// recordEvict counts an eviction and notifies the observer
+func (um *UserManager) recordEvict(userID string) {
+	um.metrics.cacheEvictions.Add(1)
+	if um.observer != nil {
+		um.observer.OnEvict(userID)
+	}
+}
+
+// NewUser creates a new user like the package-level NewUser, but with the
+// manager's default status and email normalization, ready to be passed to
+// CreateUser
+func (um *UserManager) NewUser(id, name, email string) (*User, error) {
+	if um.normalizeEmails {
+		email = NormalizeEmail(email, um.lowercaseEmails)
+	}
+	user, err := NewUser(id, name, email)
+	if err != nil {
+		return nil, err
+	}
+	user.Status = um.defaultStatus
+	return user, nil
+}
+
+// FetchUser fetches a user by ID with caching
+func (um *UserManager) FetchUser(ctx context.Context, userID string) (*User, error) {
+	if userID == "" {
+		return nil, ErrEmptyUserID
+	}
+
+	// Check cache first
+	if entry, ok := um.cacheLoad(ctx, userID); ok {
+		um.logf(ctx, "User %s found in cache", userID)
+		um.refreshAhead(ctx, userID, entry)
+		return entry.user, nil
+	}
+
+	return um.fetchUser(ctx, userID)
+}
+
+// refreshKey identifies a refresh-ahead in flight for one user in one cache
+type refreshKey struct {
+	cache  *sync.Map
+	userID string
+}
+
+// refreshAhead starts a background refresh of entry if it is within the
+// WithRefreshAhead fraction of its lifetime and no refresh of the same user
+// is already running. The refresh keeps ctx's values, such as a context
+// cache, but not its cancellation, and stops when the manager shuts down.
+func (um *UserManager) refreshAhead(ctx context.Context, userID string, entry *cacheEntry) {
+	if um.refreshAt <= 0 || entry.expiresAt.IsZero() {
+		return
+	}
+	lifetime := entry.expiresAt.Sub(entry.storedAt)
+	if entry.expiresAt.Sub(um.clock.Now()) > time.Duration(float64(lifetime)*um.refreshAt) {
+		return
+	}
+
+	key := refreshKey{cache: um.cacheFor(ctx), userID: userID}
+	if _, running := um.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	done := um.trackOp()
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(um.background, cancel)
+
+	go func() {
+		defer done()
+		defer stop()
+		defer cancel()
+		defer um.refreshing.Delete(key)
+
+		if _, err := um.fetchUser(ctx, userID); err != nil && !isSlowResponse(err) {
+			um.logf(ctx, "Refresh-ahead of user %s failed: %v", userID, err)
+		}
+	}()
+}
+
+// GetUser is FetchUser for scripts and REPL use, bounded by the manager's
+// timeout instead of a caller's context. Production code should use
+// FetchUser so cancellation and deadlines propagate.
+func (um *UserManager) GetUser(userID string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), um.timeout)
+	defer cancel()
+	return um.FetchUser(ctx, userID)
+}
+
+// FetchUserCached returns the user from the manager's cache without ever
+// making a request, and false if it isn't cached or has expired. Lookups
+// count towards the cache hit and miss metrics like FetchUser's.
+func (um *UserManager) FetchUserCached(userID string) (*User, bool) {
+	if userID == "" {
+		return nil, false
+	}
+	entry, ok := um.cacheLoad(context.Background(), userID)
+	if !ok {
+		return nil, false
+	}
+	return entry.user, true
+}
+
+// FetchUserFresh fetches a user from the API without consulting the cache,
+// then caches the result, replacing any existing entry
+func (um *UserManager) FetchUserFresh(ctx context.Context, userID string) (*User, error) {
+	if userID == "" {
+		return nil, ErrEmptyUserID
+	}
+	return um.fetchUser(ctx, userID)
+}
+
+// FetchUserWithFallback fetches a fresh copy of the user and, if the API
+// request fails, serves the cached copy instead. The returned bool reports
+// whether the user came from the cache. Without a cached copy, or with one
+// older than WithCacheMaxAge allows, the original error is returned.
+func (um *UserManager) FetchUserWithFallback(ctx context.Context, userID string) (*User, bool, error) {
+	if userID == "" {
+		return nil, false, ErrEmptyUserID
+	}
+
+	user, err := um.fetchUser(ctx, userID)
+	if err == nil || isSlowResponse(err) {
+		return user, false, err
+	}
+	if !errors.Is(err, ErrAPIError) {
+		return nil, false, err
+	}
+
+	entry, ok := um.cachePeek(ctx, userID)
+	if !ok {
+		return nil, false, err
+	}
+	if entry.tooOld(um.clock.Now(), um.cacheMaxAge) {
+		um.logf(ctx, "Cached user %s is past its max age, not serving it after fetch error", userID)
+		return nil, false, err
+	}
+
+	um.logf(ctx, "Serving stale cached user %s after fetch error: %v", userID, err)
+	return entry.user, true, nil
+}
+
+// fetchUser fetches a user from the API and caches the result.
+// When a cached copy exists, the request is made conditional on its
+// modification time and a 304 Not Modified response re-caches that copy.
+func (um *UserManager) fetchUser(ctx context.Context, userID string) (*User, error) {
+	if err := um.checkDeadline(ctx); err != nil {
+		return nil, err
+	}
+
+	query := um.withUserFields(url.Values{}).Encode()
+	url := fmt.Sprintf("%s/users/%s", um.baseURL, userID)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := um.newRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, ok := um.cachePeek(ctx, userID)
+	if ok && !cached.lastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", cached.lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to fetch user %s: %v", userID, err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	slow := um.slowResponse(resp)
+	um.captureRawResponse(userID, resp)
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		um.cacheStoreModified(ctx, userID, cached.user, cached.lastModified)
+		um.logf(ctx, "User %s not modified, cached copy kept", userID)
+		return cached.user, slow
+	}
+
+	if err := um.classifyError(ctx, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUserNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		um.logf(ctx, "Failed to fetch user %s: status %d", userID, resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	user, err := um.decodeUser(resp)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	// Cache the result
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	um.cacheStoreModified(ctx, userID, user, lastModified)
+	um.logf(ctx, "User %s fetched and cached successfully", userID)
+
+	return user, slow
+}
+
+// guard runs the work of a batch operation for one user, turning a panic
+// into an error when WithPanicRecovery is set
+func (um *UserManager) guard(ctx context.Context, userID string, work func() error) (err error) {
+	if um.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				um.logf(ctx, "Recovered from panic while processing user %s: %v\n%s", userID, r, debug.Stack())
+				err = fmt.Errorf("panic while processing user %s: %v", userID, r)
+			}
+		}()
+	}
+	return work()
+}
+
+// BatchFetchUsers fetches multiple users concurrently
+func (um *UserManager) BatchFetchUsers(ctx context.Context, userIDs []string) map[string]*User {
+	return um.BatchFetchUsersWithProgress(ctx, userIDs, nil)
+}
+
+// BatchFetchUsersWithProgress fetches multiple users concurrently like
+// BatchFetchUsers, calling progress after each user completes with the number
+// done so far and the total. Calls are serialized and done increases by one
+// each time. A nil progress disables the callbacks.
+func (um *UserManager) BatchFetchUsersWithProgress(ctx context.Context, userIDs []string, progress func(done, total int)) map[string]*User {
+	defer um.trackOp()()
+	ctx = withBatchOp(ctx)
+
+	results := make(map[string]*User)
+	done := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, 10)
+
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			semaphore <- struct{}{} // Acquire
+			defer func() { <-semaphore }() // Release
+
+			var user *User
+			err := um.guard(ctx, id, func() (err error) {
+				user, err = um.FetchUser(ctx, id)
+				return err
+			})
+
+			mu.Lock()
+			if err != nil && !isSlowResponse(err) {
+				um.logf(ctx, "Error fetching user %s: %v", id, err)
+				results[id] = nil
+			} else {
+				results[id] = user
+			}
+			done++
+			if progress != nil {
+				um.guard(ctx, id, func() error {
+					progress(done, len(userIDs))
+					return nil
+				})
+			}
+			mu.Unlock()
+		}(userID)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// FetchUsersByIDs fetches the users with the given IDs. Duplicate IDs are
+// fetched once and cached users are served directly, so only cache misses
+// cost a request and a goroutine. Users that could not be fetched are left
+// out of the map and their errors are returned joined together.
+func (um *UserManager) FetchUsersByIDs(ctx context.Context, userIDs []string) (map[string]*User, error) {
+	defer um.trackOp()()
+	ctx = withBatchOp(ctx)
+
+	results := make(map[string]*User, len(userIDs))
+	seen := make(map[string]bool, len(userIDs))
+	var misses []string
+	for _, userID := range userIDs {
+		if userID == "" {
+			return nil, ErrEmptyUserID
+		}
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		if entry, ok := um.cacheLoad(ctx, userID); ok {
+			results[userID] = entry.user
+			continue
+		}
+		misses = append(misses, userID)
+	}
+
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, 10)
+
+	for _, userID := range misses {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			semaphore <- struct{}{}        // Acquire
+			defer func() { <-semaphore }() // Release
+
+			var user *User
+			err := um.guard(ctx, id, func() (err error) {
+				user, err = um.fetchUser(ctx, id)
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && !isSlowResponse(err) {
+				errs = append(errs, fmt.Errorf("user %s: %w", id, err))
+				return
+			}
+			results[id] = user
+		}(userID)
+	}
+
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+// UpdateUser updates a user's information
+func (um *UserManager) UpdateUser(ctx context.Context, userID string, updates map[string]interface{}) error {
+	if err := um.checkDeadline(ctx); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/users/%s", um.baseURL, userID)
+
+	if metadata, ok := updates["metadata"].(map[string]interface{}); ok && um.metadataSerializer != nil {
+		serialized, err := um.metadataSerializer(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to serialize metadata: %w", err)
+		}
+		updates = maps.Clone(updates)
+		updates["metadata"] = serialized
+	}
+
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return fmt.Errorf("failed to marshal updates: %w", err)
+	}
+
+	req, err := um.newRequest(ctx, "PUT", url, data)
+	if err != nil {
+		return err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	if err := um.classifyError(ctx, resp); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+	if err := um.checkSuccess(resp); err != nil {
+		return err
+	}
+
+	// Invalidate cache
+	if !isDryRun(resp) {
+		um.cacheDelete(ctx, userID)
+		um.invalidateQueries(ctx)
+	}
+	um.logf(ctx, "User %s updated successfully", userID)
+
+	return nil
+}
+
+// CreateUser creates a new user via the API and caches the result
+func (um *UserManager) CreateUser(ctx context.Context, user *User) (*User, error) {
+	if user == nil {
+		return nil, errors.New("user cannot be nil")
+	}
+	um.assignID(user)
+	um.normalizeEmail(user)
+	if err := um.validate(user); err != nil {
+		return nil, err
+	}
+
+	data, err := um.encodeUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal user: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/users", um.baseURL)
+	req, err := um.newRequest(ctx, "POST", url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to create user %s: %v", user.ID, err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, user.ID)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		um.logf(ctx, "Failed to create user %s: status %d", user.ID, resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	created, err := um.decodeUser(resp)
+	if err != nil {
+		return nil, err
+	}
+	if created == nil {
+		return nil, fmt.Errorf("%w: empty response", ErrAPIError)
+	}
+
+	if !isDryRun(resp) {
+		um.cacheStore(ctx, created.ID, created)
+		um.invalidateQueries(ctx)
+	}
+	um.logf(ctx, "User %s created successfully", created.ID)
+
+	return created, nil
+}
+
+// NormalizeEmail trims surrounding whitespace from email and lowercases its
+// domain, and with lowercaseAll the whole address
+func NormalizeEmail(email string, lowercaseAll bool) string {
+	email = strings.TrimSpace(email)
+	if lowercaseAll {
+		return strings.ToLower(email)
+	}
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return email[:at] + strings.ToLower(email[at:])
+	}
+	return email
+}
+
+// normalizeEmail normalizes user's email if WithEmailNormalization is set
+func (um *UserManager) normalizeEmail(user *User) {
+	if !um.normalizeEmails {
+		return
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.Email = NormalizeEmail(user.Email, um.lowercaseEmails)
+}
+
+// assignID gives user a generated ID if it has none and a generator is set.
+// A generator returning an empty ID leaves the user to fail validation.
+func (um *UserManager) assignID(user *User) {
+	if um.idGenerator == nil {
+		return
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.ID == "" {
+		user.ID = um.idGenerator()
+	}
+}
+
+// validationRule is a named custom check registered on the manager
+type validationRule struct {
+	name  string
+	check func(*User) error
+}
+
+// AddValidationRule registers a custom check run after the built-in
+// Validate whenever the manager writes a user (CreateUser, CreateUsers and
+// Upsert). Rules run in registration order and the first failure stops
+// validation. Adding a rule under an existing name replaces it in place.
+func (um *UserManager) AddValidationRule(name string, rule func(*User) error) {
+	um.rulesMu.Lock()
+	defer um.rulesMu.Unlock()
+
+	for i := range um.validationRules {
+		if um.validationRules[i].name == name {
+			um.validationRules[i].check = rule
+			return
+		}
+	}
+	um.validationRules = append(um.validationRules, validationRule{name: name, check: rule})
+}
+
+// RemoveValidationRule removes the rule registered under name and reports
+// whether there was one
+func (um *UserManager) RemoveValidationRule(name string) bool {
+	um.rulesMu.Lock()
+	defer um.rulesMu.Unlock()
+
+	for i := range um.validationRules {
+		if um.validationRules[i].name == name {
+			um.validationRules = slices.Delete(um.validationRules, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// validate runs the built-in Validate followed by the registered rules
+func (um *UserManager) validate(user *User) error {
+	if err := user.Validate(); err != nil {
+		return err
+	}
+
+	um.rulesMu.RLock()
+	rules := slices.Clone(um.validationRules)
+	um.rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		if err := rule.check(user); err != nil {
+			return fmt.Errorf("validation rule %q: %w", rule.name, err)
+		}
+	}
+	return nil
+}
+
+// GetOrCreate fetches the user with u's ID and creates u if it doesn't
+// exist yet. The returned bool reports whether the user was created. If a
+// concurrent caller creates the same user first, the existing user is
+// fetched and returned instead. A user with an empty ID is created
+// directly, taking an ID from WithIDGenerator like CreateUser does.
+func (um *UserManager) GetOrCreate(ctx context.Context, u *User) (*User, bool, error) {
+	if u == nil {
+		return nil, false, errors.New("user cannot be nil")
+	}
+
+	// A user without an ID can't exist yet
+	if u.ID != "" {
+		user, err := um.FetchUser(ctx, u.ID)
+		if err == nil || isSlowResponse(err) {
+			return user, false, err
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, false, err
+		}
+	}
+
+	created, err := um.CreateUser(ctx, u)
+	if err == nil {
+		return created, true, nil
+	}
+	if !errors.Is(err, ErrUserExists) {
+		return nil, false, err
+	}
+
+	// Lost the race against another creator, so return their user
+	user, err := um.FetchUser(ctx, u.ID)
+	if err != nil && !isSlowResponse(err) {
+		return nil, false, err
+	}
+	return user, false, err
+}
+
+// Upsert stores the full user with a PUT, creating it if the server reports
+// that it doesn't exist, and caches the result
+func (um *UserManager) Upsert(ctx context.Context, u *User) (*User, error) {
+	if u == nil {
+		return nil, errors.New("user cannot be nil")
+	}
+	um.normalizeEmail(u)
+	if err := um.validate(u); err != nil {
+		return nil, err
+	}
+
+	data, err := um.encodeUser(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal user: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/users/%s", um.baseURL, u.ID)
+	req, err := um.newRequest(ctx, "PUT", url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to upsert user %s: %v", u.ID, err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		um.logf(ctx, "User %s not found on upsert, creating it", u.ID)
+		return um.CreateUser(ctx, u)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		um.logf(ctx, "Failed to upsert user %s: status %d", u.ID, resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	user, err := um.decodeUser(resp)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: empty response", ErrAPIError)
+	}
+
+	if !isDryRun(resp) {
+		um.cacheStore(ctx, u.ID, user)
+		um.invalidateQueries(ctx)
+	}
+	um.logf(ctx, "User %s upserted successfully", u.ID)
+
+	return user, nil
+}
+
+// CreateUsers creates multiple users in one call to the batch endpoint.
+// If the server does not support batch creation, the users are created
+// concurrently one by one; on mixed success the created users are returned
+// together with an aggregated error.
+func (um *UserManager) CreateUsers(ctx context.Context, users []*User) ([]*User, error) {
+	for _, user := range users {
+		if user != nil {
+			um.assignID(user)
+			um.normalizeEmail(user)
+		}
+	}
+	if err := validateAll(users, um.validate); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return []*User{}, nil
+	}
+
+	payload := make([]json.RawMessage, 0, len(users))
+	for _, user := range users {
+		data, err := um.encodeUser(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal user %s: %w", user.ID, err)
+		}
+		payload = append(payload, data)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal users: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/users/batch", um.baseURL)
+	req, err := um.newRequest(ctx, "POST", url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to create %d users: %v", len(users), err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		um.logf(ctx, "Batch create unsupported (status %d), creating users individually", resp.StatusCode)
+		return um.createUsersIndividually(ctx, users)
+	default:
+		um.logf(ctx, "Failed to create %d users: status %d", len(users), resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	var apiResp ApiResponse[[]*User]
+	if err := um.decode(resp, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if err := apiResp.Err(); err != nil {
+		return nil, err
+	}
+
+	if apiResp.Data == nil {
+		return []*User{}, nil
+	}
+
+	created := make([]*User, 0, len(*apiResp.Data))
+	for _, user := range *apiResp.Data {
+		user, err := um.prepareUser(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if user == nil || user.ID == "" {
+			continue
+		}
+		if !isDryRun(resp) {
+			um.cacheStore(ctx, user.ID, user)
+		}
+		created = append(created, user)
+	}
+	if !isDryRun(resp) {
+		um.invalidateQueries(ctx)
+	}
+	um.logf(ctx, "Created %d users via batch endpoint", len(created))
+
+	return created, nil
+}
+
+// createUsersIndividually creates users concurrently with CreateUser,
+// preserving the input order of the successfully created users
+func (um *UserManager) createUsersIndividually(ctx context.Context, users []*User) ([]*User, error) {
+	defer um.trackOp()()
+	ctx = withBatchOp(ctx)
+
+	results := make([]*User, len(users))
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, 10)
+
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user *User) {
+			defer wg.Done()
+			semaphore <- struct{}{}        // Acquire
+			defer func() { <-semaphore }() // Release
+
+			var created *User
+			err := um.guard(ctx, user.ID, func() (err error) {
+				created, err = um.CreateUser(ctx, user)
+				return err
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("user %s: %w", user.ID, err)
+				return
+			}
+			results[i] = created
+		}(i, user)
+	}
+
+	wg.Wait()
+
+	created := make([]*User, 0, len(users))
+	for _, user := range results {
+		if user != nil {
+			created = append(created, user)
+		}
+	}
+	return created, errors.Join(errs...)
+}
+
+// DeleteUser deletes a user via the API and evicts it from the cache
+func (um *UserManager) DeleteUser(ctx context.Context, userID string) error {
+	if userID == "" {
+		return ErrEmptyUserID
+	}
+
+	url := fmt.Sprintf("%s/users/%s", um.baseURL, userID)
+	req, err := um.newRequest(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound:
+		um.cacheDelete(ctx, userID)
+		um.invalidateQueries(ctx)
+		return ErrUserNotFound
+	default:
+		return fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+	if err := um.checkSuccess(resp); err != nil {
+		return err
+	}
+
+	if !isDryRun(resp) {
+		um.cacheDelete(ctx, userID)
+		um.invalidateQueries(ctx)
+	}
+	um.logf(ctx, "User %s deleted successfully", userID)
+
+	return nil
+}
+
+// BatchDeleteUsers deletes multiple users concurrently and returns the
+// outcome per ID, nil meaning deleted. A user that doesn't exist gets
+// ErrUserNotFound, or nil with WithMissingDeleteOK. IDs not yet attempted
+// when ctx is cancelled get the context's error.
+func (um *UserManager) BatchDeleteUsers(ctx context.Context, userIDs []string) map[string]error {
+	defer um.trackOp()()
+	ctx = withBatchOp(ctx)
+
+	results := make(map[string]error, len(userIDs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, 10)
+
+	for _, userID := range slices.Compact(slices.Sorted(slices.Values(userIDs))) {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			var err error
+			select {
+			case semaphore <- struct{}{}: // Acquire
+				if err = ctx.Err(); err == nil {
+					err = um.guard(ctx, id, func() error {
+						return um.DeleteUser(ctx, id)
+					})
+				}
+				<-semaphore // Release
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if errors.Is(err, ErrUserNotFound) && um.deleteMissingOK {
+				err = nil
+			}
+
+			mu.Lock()
+			results[id] = err
+			mu.Unlock()
+		}(userID)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// BatchOpKind identifies the kind of operation in a BatchOps
+type BatchOpKind int
+
+const (
+	BatchOpCreate BatchOpKind = iota
+	BatchOpUpdate
+	BatchOpDelete
+)
+
+// String implements the Stringer interface
+func (k BatchOpKind) String() string {
+	switch k {
+	case BatchOpCreate:
+		return "create"
+	case BatchOpUpdate:
+		return "update"
+	case BatchOpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// BatchOp is a single operation queued in a BatchOps
+type BatchOp struct {
+	Kind    BatchOpKind
+	UserID  string
+	User    *User
+	Updates map[string]interface{}
+}
+
+// BatchOps collects create, update and delete operations to apply together
+type BatchOps struct {
+	ops []BatchOp
+}
+
+// NewBatchOps creates an empty batch of operations
+func NewBatchOps() *BatchOps {
+	return &BatchOps{}
+}
+
+// Create queues the creation of a user
+func (b *BatchOps) Create(user *User) *BatchOps {
+	op := BatchOp{Kind: BatchOpCreate, User: user}
+	if user != nil {
+		op.UserID = user.ID
+	}
+	b.ops = append(b.ops, op)
+	return b
+}
+
+// Update queues an update of the given user
+func (b *BatchOps) Update(userID string, updates map[string]interface{}) *BatchOps {
+	b.ops = append(b.ops, BatchOp{Kind: BatchOpUpdate, UserID: userID, Updates: updates})
+	return b
+}
+
+// Delete queues the deletion of the given user
+func (b *BatchOps) Delete(userID string) *BatchOps {
+	b.ops = append(b.ops, BatchOp{Kind: BatchOpDelete, UserID: userID})
+	return b
+}
+
+// Len returns the number of queued operations
+func (b *BatchOps) Len() int {
+	return len(b.ops)
+}
+
+// BatchOpResult is the outcome of a single operation in a batch
+type BatchOpResult struct {
+	Op   BatchOp
+	User *User
+	Err  error
+}
+
+// BatchResult holds the per-operation outcomes of ApplyBatch, in queue order
+type BatchResult struct {
+	Results   []BatchOpResult
+	Succeeded int
+	Failed    int
+}
+
+// ApplyBatch executes the queued operations and reports the outcome of each
+// one. Operations on the same user ID run one after another in queue order,
+// so a create, update and delete of one user reach the server in that order;
+// operations on different users run concurrently. Operations queued without
+// a user ID are independent of all others. A failed operation doesn't stop
+// later ones on the same user. The returned error aggregates all failed
+// operations.
+func (um *UserManager) ApplyBatch(ctx context.Context, ops *BatchOps) (BatchResult, error) {
+	if ops == nil || len(ops.ops) == 0 {
+		return BatchResult{Results: []BatchOpResult{}}, nil
+	}
+
+	defer um.trackOp()()
+	ctx = withBatchOp(ctx)
+
+	// Group the operations by user, keeping queue order within each group
+	var groups [][]int
+	groupOf := make(map[string]int)
+	for i, op := range ops.ops {
+		if op.UserID == "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+		g, ok := groupOf[op.UserID]
+		if !ok {
+			g = len(groups)
+			groupOf[op.UserID] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	results := make([]BatchOpResult, len(ops.ops))
+	var wg sync.WaitGroup
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, 10)
+
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			for _, i := range group {
+				semaphore <- struct{}{} // Acquire
+				results[i] = um.applyBatchOp(ctx, ops.ops[i])
+				<-semaphore // Release
+			}
+		}(group)
+	}
+
+	wg.Wait()
+
+	batch := BatchResult{Results: results}
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			batch.Failed++
+			errs = append(errs, fmt.Errorf("%s %s: %w", result.Op.Kind, result.Op.UserID, result.Err))
+		} else {
+			batch.Succeeded++
+		}
+	}
+	um.logf(ctx, "Batch applied: %d succeeded, %d failed", batch.Succeeded, batch.Failed)
+
+	return batch, errors.Join(errs...)
+}
+
+// applyBatchOp executes a single operation of ApplyBatch
+func (um *UserManager) applyBatchOp(ctx context.Context, op BatchOp) BatchOpResult {
+	result := BatchOpResult{Op: op}
+	result.Err = um.guard(ctx, op.UserID, func() (err error) {
+		switch op.Kind {
+		case BatchOpCreate:
+			result.User, err = um.CreateUser(ctx, op.User)
+		case BatchOpUpdate:
+			err = um.UpdateUser(ctx, op.UserID, op.Updates)
+		case BatchOpDelete:
+			err = um.DeleteUser(ctx, op.UserID)
+		default:
+			err = fmt.Errorf("unknown batch operation: %d", op.Kind)
+		}
+		return err
+	})
+	return result
+}
+
+// ErrNoRecordedResponse is returned by ReplayTransport for unknown requests
+var ErrNoRecordedResponse = errors.New("no recorded response for request")
+
+// CassetteEntry is a single recorded request/response pair
+type CassetteEntry struct {
+	Key        string      `json:"key"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// Cassette holds recorded HTTP interactions in the order they happened
+type Cassette struct {
+	Entries []CassetteEntry `json:"entries"`
+}
+
+// LoadCassette reads a cassette previously written by SaveCassette
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("failed to decode cassette: %w", err)
+	}
+	return &cassette, nil
+}
+
+// SaveCassette writes the cassette to path as indented JSON
+func SaveCassette(path string, cassette *Cassette) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return nil
+}
+
+// cassetteKey identifies a request by method, path and query, plus a hash
+// of the body when there is one
+func cassetteKey(req *http.Request, body []byte) string {
+	key := req.Method + " " + req.URL.RequestURI()
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		key += " " + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// readRequestBody reads the body of req without modifying req. It reads a
+// copy from req.GetBody when set; otherwise it consumes req.Body and returns
+// a clone of req carrying the body again, which must be sent in its place.
+func readRequestBody(req *http.Request) (*http.Request, []byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil, nil
+	}
+
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rc.Close()
+		body, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return req, body, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone, body, nil
+}
+
+// RecordingTransport is an http.RoundTripper that records every interaction
+// passing through it so it can be saved as a cassette
+type RecordingTransport struct {
+	Transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecordingTransport creates a recording transport wrapping next, or
+// http.DefaultTransport when next is nil
+func NewRecordingTransport(next http.RoundTripper) *RecordingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RecordingTransport{Transport: next}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	t.mu.Lock()
+	t.cassette.Entries = append(t.cassette.Entries, CassetteEntry{
+		Key:        cassetteKey(req, reqBody),
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       string(respBody),
+	})
+	t.mu.Unlock()
+
+	return resp, nil
+}
+
+// Cassette returns a copy of everything recorded so far
+func (t *RecordingTransport) Cassette() *Cassette {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &Cassette{Entries: append([]CassetteEntry(nil), t.cassette.Entries...)}
+}
+
+// Save writes everything recorded so far to path
+func (t *RecordingTransport) Save(path string) error {
+	return SaveCassette(path, t.Cassette())
+}
+
+// ReplayTransport is an http.RoundTripper that serves responses from a
+// cassette instead of the network. Repeated requests with the same key are
+// answered in recording order; the last matching entry is reused once the
+// others are consumed.
+type ReplayTransport struct {
+	mu      sync.Mutex
+	entries map[string][]CassetteEntry
+}
+
+// NewReplayTransport creates a replay transport serving the given cassette
+func NewReplayTransport(cassette *Cassette) *ReplayTransport {
+	t := &ReplayTransport{entries: make(map[string][]CassetteEntry)}
+	if cassette != nil {
+		for _, entry := range cassette.Entries {
+			t.entries[entry.Key] = append(t.entries[entry.Key], entry)
+		}
+	}
+	return t
+}
+
+// LoadReplayTransport creates a replay transport from a cassette file
+func LoadReplayTransport(path string) (*ReplayTransport, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayTransport(cassette), nil
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, body, err := readRequestBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	key := cassetteKey(req, body)
+
+	t.mu.Lock()
+	recorded := t.entries[key]
+	if len(recorded) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoRecordedResponse, key)
+	}
+	entry := recorded[0]
+	if len(recorded) > 1 {
+		t.entries[key] = recorded[1:]
+	}
+	t.mu.Unlock()
+
+	header := entry.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}, nil
+}
+
+// FilterUsersByStatus filters users by status
+func (um *UserManager) FilterUsersByStatus(users []*User, status UserStatus) []*User {
+	var filtered []*User
+	for _, user := range users {
+		if user.Status == status {
+			filtered = append(filtered, user)
+		}
+	}
+	return filtered
+}
+
+// FilterUsers returns the users for which keep returns true, skipping nils
+func FilterUsers(users []*User, keep func(*User) bool) []*User {
+	var filtered []*User
+	for _, user := range users {
+		if user != nil && keep(user) {
+			filtered = append(filtered, user)
+		}
+	}
+	return filtered
+}
+
+// FilterExpiredUsers returns the users for which IsExpired is true, in
+// order. The result is never nil.
+func FilterExpiredUsers(users []*User) []*User {
+	return nonNilUsers(FilterUsers(users, (*User).IsExpired))
+}
+
+// FilterActiveUsers returns the users for which IsActive is true, in order.
+// The result is never nil.
+func FilterActiveUsers(users []*User) []*User {
+	return nonNilUsers(FilterUsers(users, (*User).IsActive))
+}
+
+// CountByStatus returns how many users have status, skipping nils
+func CountByStatus(users []*User, status UserStatus) int {
+	count := 0
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		user.mu.RLock()
+		if user.Status == status {
+			count++
+		}
+		user.mu.RUnlock()
+	}
+	return count
+}
+
+// CountActive returns how many users are active, skipping nils
+func CountActive(users []*User) int {
+	return CountByStatus(users, StatusActive)
+}
+
+// FilterByAgeCategory returns the users in the given age category, in
+// order, using the same bucketing as AgeCategoryValue. The result is never
+// nil; an undefined category is an error.
+func FilterByAgeCategory(users []*User, category AgeCategory) ([]*User, error) {
+	if !category.IsValid() {
+		return nil, fmt.Errorf("invalid age category: %d", category)
+	}
+	return nonNilUsers(FilterUsers(users, func(user *User) bool {
+		return user.AgeCategoryValue() == category
+	})), nil
+}
+
+// nonNilUsers returns users, or an empty slice if it is nil
+func nonNilUsers(users []*User) []*User {
+	if users == nil {
+		return []*User{}
+	}
+	return users
+}
+
+// FilterUsersByMetadata returns the users whose metadata key holds value.
+// Comparable values of the same type are compared with ==, anything else
+// (slices, maps) with reflect.DeepEqual, so an int never matches a float64.
+func FilterUsersByMetadata(users []*User, key string, value interface{}) []*User {
+	return FilterUsersByMetadataAll(users, map[string]interface{}{key: value})
+}
+
+// FilterUsersByMetadataAll returns the users whose metadata matches every
+// key/value pair, using the same comparison as FilterUsersByMetadata
+func FilterUsersByMetadataAll(users []*User, pairs map[string]interface{}) []*User {
+	return FilterUsers(users, func(user *User) bool {
+		user.mu.RLock()
+		defer user.mu.RUnlock()
+		for key, want := range pairs {
+			got, ok := user.Metadata[key]
+			if !ok || !metadataEqual(got, want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// metadataEqual reports whether two metadata values are equal
+func metadataEqual(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.IsValid() && vb.IsValid() && va.Type() == vb.Type() && va.Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// SortUsersByMetadata sorts users in place by the value of a metadata key.
+// Values must be all numeric (any int, uint or float type, or json.Number)
+// or all strings; a mix, or any other type, returns an error and leaves
+// users untouched. Users without the key or with a nil value, and nil users,
+// are moved to the end in their original order. The sort is stable.
+func SortUsersByMetadata(users []*User, key string, ascending bool) error {
+	type sortEntry struct {
+		user    *User
+		present bool
+		num     float64
+		str     string
+	}
+
+	entries := make([]sortEntry, len(users))
+	kind := ""
+	for i, user := range users {
+		entries[i].user = user
+		if user == nil {
+			continue
+		}
+		value, ok := user.GetMetadata(key)
+		if !ok || value == nil {
+			continue
+		}
+
+		entryKind := "number"
+		if str, isString := value.(string); isString {
+			entryKind = "string"
+			entries[i].str = str
+		} else if num, isNumber := metadataNumber(value); isNumber {
+			entries[i].num = num
+		} else {
+			return fmt.Errorf("metadata %q of user %s has unsortable type %T", key, user.ID, value)
+		}
+
+		if kind != "" && kind != entryKind {
+			return fmt.Errorf("metadata %q mixes %s and %s values", key, kind, entryKind)
+		}
+		kind = entryKind
+		entries[i].present = true
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.present != b.present {
+			return a.present
+		}
+		if !a.present {
+			return false
+		}
+		if !ascending {
+			a, b = b, a
+		}
+		if kind == "string" {
+			return a.str < b.str
+		}
+		return a.num < b.num
+	})
+
+	for i, entry := range entries {
+		users[i] = entry.user
+	}
+	return nil
+}
+
+// metadataNumber converts a numeric metadata value to a float64
+func metadataNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// SetStatusAll sets the status of every non-nil user and returns how many
+// users actually changed
+func SetStatusAll(users []*User, status UserStatus) int {
+	changed := 0
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		user.mu.Lock()
+		if user.Status != status {
+			user.Status = status
+			changed++
+		}
+		user.mu.Unlock()
+	}
+	return changed
+}
+
+// GetUsersByStatus fetches all users with the given status from the API
+func (um *UserManager) GetUsersByStatus(ctx context.Context, status UserStatus) ([]*User, error) {
+	if !status.IsValid() {
+		return nil, fmt.Errorf("invalid user status: %d", status)
+	}
+
+	query := um.withUserFields(url.Values{})
+	query.Set("status", status.String())
+	endpoint := fmt.Sprintf("%s/users?%s", um.baseURL, query.Encode())
+	if cached, ok := um.queryCacheLoad(ctx, endpoint); ok {
+		return slices.Clone(cached.([]*User)), nil
+	}
+
+	req, err := um.newRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to fetch %s users: %v", status, err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		um.logf(ctx, "Failed to fetch %s users: status %d", status, resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	var apiResp ApiResponse[[]*User]
+	if err := um.decode(resp, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if err := apiResp.Err(); err != nil {
+		return nil, err
+	}
+
+	if apiResp.Data == nil {
+		return []*User{}, nil
+	}
+
+	// Cache every user returned by the list endpoint
+	users := make([]*User, 0, len(*apiResp.Data))
+	for _, user := range *apiResp.Data {
+		user, err := um.prepareUser(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if user == nil || user.ID == "" {
+			continue
+		}
+		um.cacheStore(ctx, user.ID, user)
+		users = append(users, user)
+	}
+	um.queryCacheStore(ctx, endpoint, slices.Clone(users))
+	um.logf(ctx, "Fetched and cached %d %s users", len(users), status)
+
+	return users, um.slowResponse(resp)
+}
+
+// PaginatedResponse is one page of a listing
+type PaginatedResponse[T any] struct {
+	Items    []T  `json:"items" xml:"items>item"`
+	Page     int  `json:"page" xml:"page"`
+	PageSize int  `json:"page_size" xml:"page_size"`
+	Total    int  `json:"total" xml:"total"`
+	HasMore  bool `json:"has_more" xml:"has_more"`
+}
+
+// UserQuery filters and orders a server-side user listing. Zero-valued
+// fields are left out of the request, leaving the server defaults.
+type UserQuery struct {
+	Status       *UserStatus
+	CreatedAfter time.Time
+	Search       string
+	Page         int
+	PageSize     int
+	SortBy       string
+	SortDesc     bool
+}
+
+// values encodes the query as URL parameters
+func (q UserQuery) values() url.Values {
+	values := url.Values{}
+	if q.Status != nil {
+		values.Set("status", q.Status.String())
+	}
+	if !q.CreatedAfter.IsZero() {
+		values.Set("created_after", q.CreatedAfter.UTC().Format(time.RFC3339))
+	}
+	if q.Search != "" {
+		values.Set("search", q.Search)
+	}
+	if q.Page > 0 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PageSize > 0 {
+		values.Set("page_size", strconv.Itoa(q.PageSize))
+	}
+	if q.SortBy != "" {
+		values.Set("sort_by", q.SortBy)
+		if q.SortDesc {
+			values.Set("sort_desc", "true")
+		}
+	}
+	return values
+}
+
+// QueryUsers fetches one page of users matching q from the API and caches
+// the users it returns
+func (um *UserManager) QueryUsers(ctx context.Context, q UserQuery) (*PaginatedResponse[*User], error) {
+	if q.Status != nil && !q.Status.IsValid() {
+		return nil, fmt.Errorf("invalid user status: %d", *q.Status)
+	}
+	if q.Page < 0 || q.PageSize < 0 {
+		return nil, fmt.Errorf("invalid page %d or page size %d", q.Page, q.PageSize)
+	}
+
+	endpoint := fmt.Sprintf("%s/users", um.baseURL)
+	if query := um.withUserFields(q.values()).Encode(); query != "" {
+		endpoint += "?" + query
+	}
+	if cached, ok := um.queryCacheLoad(ctx, endpoint); ok {
+		page := *cached.(*PaginatedResponse[*User])
+		page.Items = slices.Clone(page.Items)
+		return &page, nil
+	}
+
+	req, err := um.newRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := um.do(req)
+	if err != nil {
+		um.logf(ctx, "Failed to query users: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrAPIError, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		um.logf(ctx, "Failed to query users: status %d", resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAPIError, resp.StatusCode)
+	}
+
+	var apiResp ApiResponse[PaginatedResponse[*User]]
+	if err := um.decode(resp, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if err := apiResp.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &PaginatedResponse[*User]{}
+	if apiResp.Data != nil {
+		page = apiResp.Data
+	}
+
+	users := make([]*User, 0, len(page.Items))
+	for _, user := range page.Items {
+		user, err := um.prepareUser(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if user == nil || user.ID == "" {
+			continue
+		}
+		um.cacheStore(ctx, user.ID, user)
+		users = append(users, user)
+	}
+	page.Items = users
+
+	cached := *page
+	cached.Items = slices.Clone(users)
+	um.queryCacheStore(ctx, endpoint, &cached)
+
+	return page, um.slowResponse(resp)
+}
+
+// ListAllUsers iterates over every user matching q, fetching page after
+// page with QueryUsers, starting from q.Page (or the first page), until the
+// server reports no more. Iteration stops at the first error, which is
+// yielded with a nil user: ErrResultLimitExceeded when WithMaxResults or
+// WithMaxPages cuts the listing short, or ErrAPIError when the server
+// reports more users but returns an empty page.
+func (um *UserManager) ListAllUsers(ctx context.Context, q UserQuery) iter.Seq2[*User, error] {
+	return func(yield func(*User, error) bool) {
+		if q.Page == 0 {
+			q.Page = 1
+		}
+
+		yielded := 0
+		for pages := 0; ; pages++ {
+			if um.maxPages > 0 && pages >= um.maxPages {
+				yield(nil, fmt.Errorf("%w: stopped after %d pages", ErrResultLimitExceeded, pages))
+				return
+			}
+
+			page, err := um.QueryUsers(ctx, q)
+			if err != nil && !isSlowResponse(err) {
+				yield(nil, err)
+				return
+			}
+
+			for _, user := range page.Items {
+				if um.maxResults > 0 && yielded >= um.maxResults {
+					yield(nil, fmt.Errorf("%w: stopped after %d users", ErrResultLimitExceeded, yielded))
+					return
+				}
+				if !yield(user, nil) {
+					return
+				}
+				yielded++
+			}
+
+			if !page.HasMore {
+				return
+			}
+			if len(page.Items) == 0 {
+				yield(nil, fmt.Errorf("%w: empty page %d with more results reported", ErrAPIError, q.Page))
+				return
+			}
+			if um.maxResults > 0 && yielded >= um.maxResults {
+				yield(nil, fmt.Errorf("%w: stopped after %d users", ErrResultLimitExceeded, yielded))
+				return
+			}
+			q.Page++
+		}
+	}
+}
+
+// UserStatistics represents user statistics
+type UserStatistics struct {
+	Total              int     `json:"total"`
+	Active             int     `json:"active"`
+	Inactive           int     `json:"inactive"`
+	Pending            int     `json:"pending"`
+	Suspended          int     `json:"suspended"`
+	AverageDaysActive  float64 `json:"average_days_active"`
+}
+
+// GetUserStatistics calculates user statistics
+func (um *UserManager) GetUserStatistics(users []*User) UserStatistics {
+	return um.GetUserStatisticsStream(slices.Values(users))
+}
+
+// GetUserStatisticsParallel calculates the same statistics as
+// GetUserStatistics, splitting users into contiguous chunks that up to
+// workers goroutines count into their own accumulators, which are then
+// merged. workers below 1 counts as 1.
+func (um *UserManager) GetUserStatisticsParallel(users []*User, workers int) UserStatistics {
+	workers = max(1, min(workers, len(users)))
+	chunk := (len(users) + workers - 1) / workers
+
+	partials := make([]StatisticsAccumulator, workers)
+	var wg sync.WaitGroup
+	for i := range partials {
+		start := min(i*chunk, len(users))
+		end := min(start+chunk, len(users))
+		wg.Add(1)
+		go func(acc *StatisticsAccumulator, part []*User) {
+			defer wg.Done()
+			for _, user := range part {
+				acc.Add(user)
+			}
+		}(&partials[i], users[start:end])
+	}
+	wg.Wait()
+
+	var total StatisticsAccumulator
+	for i := range partials {
+		total.Merge(&partials[i])
+	}
+	return total.Snapshot()
+}
+
+// InvalidEmailDomain is the GetUserStatisticsByDomain bucket for users whose
+// email is invalid
+const InvalidEmailDomain = "(invalid)"
+
+// GetUserStatisticsByDomain calculates user statistics per lowercased email
+// domain. Users with invalid emails are counted under InvalidEmailDomain if
+// includeInvalid is set and left out otherwise; nil users are skipped.
+func (um *UserManager) GetUserStatisticsByDomain(users []*User, includeInvalid bool) map[string]UserStatistics {
+	buckets := make(map[string][]*User)
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+
+		user.mu.RLock()
+		email := user.Email
+		user.mu.RUnlock()
+
+		domain := InvalidEmailDomain
+		if isValidEmail(email) {
+			domain = strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+		} else if !includeInvalid {
+			continue
+		}
+		buckets[domain] = append(buckets[domain], user)
+	}
+
+	stats := make(map[string]UserStatistics, len(buckets))
+	for domain, bucket := range buckets {
+		stats[domain] = um.GetUserStatistics(bucket)
+	}
+	return stats
+}
+
+// GetUserStatisticsStream calculates user statistics over a sequence of
+// users one at a time, so the users never have to be held in memory together
+func (um *UserManager) GetUserStatisticsStream(seq iter.Seq[*User]) UserStatistics {
+	var acc StatisticsAccumulator
+	for user := range seq {
+		acc.Add(user)
+	}
+	return acc.Snapshot()
+}
+
+// StatisticsAccumulator aggregates user statistics incrementally. It is safe
+// for concurrent use, so several workers can feed one accumulator, or each
+// feed its own and combine them with Merge. The zero value is ready to use.
+// Ages are measured by the local clock, not ServerNow.
+type StatisticsAccumulator struct {
+	mu        sync.Mutex
+	stats     UserStatistics
+	totalDays int
+}
+
+// Add counts a user; nil users are ignored
+func (a *StatisticsAccumulator) Add(user *User) {
+	if user == nil {
+		return
+	}
+
+	user.mu.RLock()
+	status := user.Status
+	days := int(time.Since(user.CreatedAt).Hours() / 24)
+	user.mu.RUnlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stats.Total++
+	switch status {
+	case StatusActive:
+		a.stats.Active++
+	case StatusInactive:
+		a.stats.Inactive++
+	case StatusPending:
+		a.stats.Pending++
+	case StatusSuspended:
+		a.stats.Suspended++
+	}
+	a.totalDays += days
+}
+
+// Merge adds everything counted by other into a. The average is recomputed
+// from the combined day totals, so it is weighted by each side's count.
+func (a *StatisticsAccumulator) Merge(other *StatisticsAccumulator) {
+	if other == nil {
+		return
+	}
+
+	other.mu.Lock()
+	stats, totalDays := other.stats, other.totalDays
+	other.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stats.Total += stats.Total
+	a.stats.Active += stats.Active
+	a.stats.Inactive += stats.Inactive
+	a.stats.Pending += stats.Pending
+	a.stats.Suspended += stats.Suspended
+	a.totalDays += totalDays
+}
+
+// Snapshot returns the statistics of everything added so far
+func (a *StatisticsAccumulator) Snapshot() UserStatistics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := a.stats
+	if stats.Total > 0 {
+		stats.AverageDaysActive = float64(a.totalDays) / float64(stats.Total)
+	}
+	return stats
+}
+
+// CountActiveWithin counts active users whose lastLoginKey metadata holds a
+// time within the last window. The value may be a time.Time or an RFC 3339
+// string; users with a missing or unparsable value are not counted.
+func CountActiveWithin(users []*User, window time.Duration, lastLoginKey string) int {
+	cutoff := time.Now().Add(-window)
+	count := 0
+	for _, user := range users {
+		if user == nil || !user.IsActive() {
+			continue
+		}
+		value, ok := user.GetMetadata(lastLoginKey)
+		if !ok {
+			continue
+		}
+		if lastLogin, ok := metadataTime(value); ok && !lastLogin.Before(cutoff) {
+			count++
+		}
+	}
+	return count
+}
+
+// metadataTime interprets a metadata value as a point in time
+func metadataTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case *time.Time:
+		if v == nil {
+			return time.Time{}, false
+		}
+		return *v, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Error categories reported in ManagerMetrics.ErrorsByCategory
+const (
+	ErrorCategoryNetwork = "network" // the request could not be completed
+	ErrorCategoryStatus  = "status"  // the server answered with a 4xx or 5xx status
+	ErrorCategoryDecode  = "decode"  // the response body could not be decoded
+)
+
+// managerMetrics holds the counters behind MetricsSnapshot
+type managerMetrics struct {
+	cacheHits      atomic.Int64
+	cacheMisses    atomic.Int64
+	cacheEvictions atomic.Int64
+	requests       atomic.Int64
+	networkErrors  atomic.Int64
+	statusErrors   atomic.Int64
+	decodeErrors   atomic.Int64
+	slowResponses  atomic.Int64
+	totalLatency   atomic.Int64 // nanoseconds
+	since          atomic.Int64 // unix nanoseconds
+}
+
+// ManagerMetrics is a point-in-time view of a manager's counters
+type ManagerMetrics struct {
+	CacheHits        int64            `json:"cache_hits"`
+	CacheMisses      int64            `json:"cache_misses"`
+	CacheEvictions   int64            `json:"cache_evictions"`
+	Requests         int64            `json:"requests"`
+	Errors           int64            `json:"errors"`
+	ErrorsByCategory map[string]int64 `json:"errors_by_category"`
+	SlowResponses    int64            `json:"slow_responses"`
+	AverageLatency   time.Duration    `json:"average_latency"`
+	Since            time.Time        `json:"since"`
+}
+
+// MetricsSnapshot returns the manager's counters accumulated since it was
+// created or since the last ResetMetrics
+func (um *UserManager) MetricsSnapshot() ManagerMetrics {
+	m := &um.metrics
+	snapshot := ManagerMetrics{
+		CacheHits:      m.cacheHits.Load(),
+		CacheMisses:    m.cacheMisses.Load(),
+		CacheEvictions: m.cacheEvictions.Load(),
+		Requests:       m.requests.Load(),
+		ErrorsByCategory: map[string]int64{
+			ErrorCategoryNetwork: m.networkErrors.Load(),
+			ErrorCategoryStatus:  m.statusErrors.Load(),
+			ErrorCategoryDecode:  m.decodeErrors.Load(),
+		},
+		SlowResponses: m.slowResponses.Load(),
+		Since:         time.Unix(0, m.since.Load()),
+	}
+	for _, count := range snapshot.ErrorsByCategory {
+		snapshot.Errors += count
+	}
+	if snapshot.Requests > 0 {
+		snapshot.AverageLatency = time.Duration(m.totalLatency.Load() / snapshot.Requests)
+	}
+	return snapshot
+}
+
+// ResetMetrics sets every counter back to zero
+func (um *UserManager) ResetMetrics() {
+	m := &um.metrics
+	m.cacheHits.Store(0)
+	m.cacheMisses.Store(0)
+	m.cacheEvictions.Store(0)
+	m.requests.Store(0)
+	m.networkErrors.Store(0)
+	m.statusErrors.Store(0)
+	m.decodeErrors.Store(0)
+	m.slowResponses.Store(0)
+	m.totalLatency.Store(0)
+	m.since.Store(time.Now().UnixNano())
+}
+
+// CacheLen returns the number of entries in the manager's cache under its
+// key prefix, including expired entries that haven't been replaced yet. It
+// ranges over the cache, so its cost grows with the number of entries.
+func (um *UserManager) CacheLen() int {
+	count := 0
+	um.cache.Range(func(key, value interface{}) bool {
+		if _, ok := um.userIDFromKey(key); ok {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// ClearCache clears the user cache and returns the number of entries cleared
+func (um *UserManager) ClearCache() int {
+	count := 0
 	um.cache.Range(func(key, value interface{}) bool {
-		um.cache.Delete(key)
-		count++
+		userID, ok := um.userIDFromKey(key)
+		if !ok {
+			return true
+		}
+		if _, loaded := um.cache.LoadAndDelete(key); loaded {
+			count++
+			um.recordEvict(userID)
+		}
 		return true
 	})
 	log.Printf("Cache cleared: %d entries removed", count)
 	return count
 }
 
+// MaxBackgroundRefresh caps how many cached users are refreshed per cycle
+const MaxBackgroundRefresh = 100
+
+// StartBackgroundRefresh periodically re-fetches the most recently accessed
+// cached users (up to MaxBackgroundRefresh per cycle) to keep them warm.
+// Each cycle waits interval plus or minus up to 10% jitter so managers
+// started together don't refresh in lockstep. It stops when ctx is cancelled
+// or the manager is shut down.
+func (um *UserManager) StartBackgroundRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		um.logf(ctx, "Background refresh not started: invalid interval %v", interval)
+		return
+	}
+
+	done := um.trackOp()
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(um.background, cancel)
+
+	go func() {
+		defer done()
+		defer stop()
+		defer cancel()
+
+		for {
+			timer := time.NewTimer(jitter(interval, 0.1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			refreshed := um.refreshRecentlyAccessed(ctx, MaxBackgroundRefresh)
+			um.logf(ctx, "Background refresh: %d users refreshed", refreshed)
+		}
+	}()
+}
+
+// refreshRecentlyAccessed re-fetches up to limit cached users, most recently
+// accessed first, and returns how many were refreshed successfully
+func (um *UserManager) refreshRecentlyAccessed(ctx context.Context, limit int) int {
+	type candidate struct {
+		id         string
+		accessedAt int64
+	}
+
+	var candidates []candidate
+	um.cache.Range(func(key, value interface{}) bool {
+		userID, ok := um.userIDFromKey(key)
+		if !ok {
+			return true
+		}
+		entry := value.(*cacheEntry)
+		candidates = append(candidates, candidate{id: userID, accessedAt: entry.accessedAt.Load()})
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessedAt > candidates[j].accessedAt
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	ctx = withBatchOp(ctx)
+	refreshed := 0
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, err := um.fetchUser(ctx, c.id); err != nil && !isSlowResponse(err) {
+			um.logf(ctx, "Background refresh of user %s failed: %v", c.id, err)
+			continue
+		}
+		refreshed++
+	}
+	return refreshed
+}
+
+// trackOp registers an in-flight batch or background operation that Shutdown
+// waits for and returns the function that marks it finished. Operations
+// started after Shutdown are not tracked.
+func (um *UserManager) trackOp() (done func()) {
+	um.lifecycleMu.Lock()
+	defer um.lifecycleMu.Unlock()
+
+	if um.shutdown {
+		return func() {}
+	}
+	um.inflight.Add(1)
+	return um.inflight.Done
+}
+
+// Shutdown stops background loops, waits for in-flight batch operations to
+// finish and closes idle connections, unless the manager uses
+// WithSharedTransport, whose pool other managers may still be using. If ctx
+// expires first, the manager's base context is cancelled to abort the
+// remaining requests and Shutdown returns ctx.Err() without waiting further.
+func (um *UserManager) Shutdown(ctx context.Context) error {
+	um.lifecycleMu.Lock()
+	um.shutdown = true
+	um.lifecycleMu.Unlock()
+
+	um.stopBackground()
+
+	drained := make(chan struct{})
+	go func() {
+		um.inflight.Wait()
+		close(drained)
+	}()
+
+	if !um.sharedTransport {
+		defer um.client.CloseIdleConnections()
+	}
+
+	select {
+	case <-drained:
+		log.Printf("User manager shut down")
+		return nil
+	case <-ctx.Done():
+		um.cancelBase()
+		log.Printf("User manager shutdown interrupted: %v", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// jitter returns d randomly adjusted by up to plus or minus fraction*d
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * fraction * float64(d)
+	return d + time.Duration(delta)
+}
+
+// DrainCache removes every entry from the cache and returns the users it
+// held. Each entry is removed with LoadAndDelete, so an entry drained here is
+// never also returned by a concurrent drain or clear; entries stored while
+// the drain is running may or may not be included.
+func (um *UserManager) DrainCache() []*User {
+	var users []*User
+	um.cache.Range(func(key, value interface{}) bool {
+		userID, ok := um.userIDFromKey(key)
+		if !ok {
+			return true
+		}
+		if value, loaded := um.cache.LoadAndDelete(key); loaded {
+			users = append(users, value.(*cacheEntry).user)
+			um.recordEvict(userID)
+		}
+		return true
+	})
+	log.Printf("Cache drained: %d entries removed", len(users))
+	return users
+}
+
+// SearchCached searches the manager's cache, without making requests, for
+// users whose fields contain query, ignoring case. fields may be "id",
+// "name" and "email" and default to name and email; unknown fields never
+// match. Expired entries are skipped. Matches are returned ordered by ID.
+func (um *UserManager) SearchCached(query string, fields ...string) []*User {
+	if len(fields) == 0 {
+		fields = []string{"name", "email"}
+	}
+	query = strings.ToLower(query)
+	now := um.clock.Now()
+
+	type match struct {
+		id   string
+		user *User
+	}
+	var matches []match
+	um.cache.Range(func(key, value interface{}) bool {
+		if _, ok := um.userIDFromKey(key); !ok {
+			return true
+		}
+		entry := value.(*cacheEntry)
+		if entry.expired(now) || entry.tooOld(now, um.cacheMaxAge) {
+			return true
+		}
+
+		user := entry.user
+		user.mu.RLock()
+		defer user.mu.RUnlock()
+		for _, field := range fields {
+			var text string
+			switch field {
+			case "id":
+				text = user.ID
+			case "name":
+				text = user.Name
+			case "email":
+				text = user.Email
+			default:
+				continue
+			}
+			if strings.Contains(strings.ToLower(text), query) {
+				matches = append(matches, match{id: user.ID, user: user})
+				break
+			}
+		}
+		return true
+	})
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].id < matches[j].id
+	})
+	users := make([]*User, len(matches))
+	for i, m := range matches {
+		users[i] = m.user
+	}
+	return users
+}
+
+// ExportUsers exports users in the given format
+func (um *UserManager) ExportUsers(users []*User, format Format) (string, error) {
+	switch format {
+	case FormatJSON:
+		return um.ExportUsersJSON(users)
+	case FormatXML:
+		return um.ExportUsersXML(users)
+	case FormatCSV:
+		return um.ExportUsersCSV(users)
+	case FormatNDJSON:
+		var buf strings.Builder
+		if err := um.WriteUsers(&buf, users, format); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported format: %q", format)
+	}
+}
+
+// ExportUsersMulti exports users in each of formats concurrently and returns
+// the output keyed by format. Duplicate formats are exported once. The first
+// error is returned as soon as it occurs, together with no outputs.
+func (um *UserManager) ExportUsersMulti(users []*User, formats []Format) (map[Format]string, error) {
+	type result struct {
+		format Format
+		output string
+		err    error
+	}
+
+	seen := make(map[Format]bool, len(formats))
+	results := make(chan result, len(formats))
+	for _, format := range formats {
+		if seen[format] {
+			continue
+		}
+		seen[format] = true
+
+		go func(format Format) {
+			output, err := um.ExportUsers(users, format)
+			results <- result{format: format, output: output, err: err}
+		}(format)
+	}
+
+	outputs := make(map[Format]string, len(seen))
+	for range seen {
+		r := <-results
+		if r.err != nil {
+			return nil, fmt.Errorf("export %s: %w", r.format, r.err)
+		}
+		outputs[r.format] = r.output
+	}
+	return outputs, nil
+}
+
+// WriteUsers streams users to w in the given format, encoding one user at a
+// time so memory use doesn't grow with the number of users. JSON is written
+// as a compact array, NDJSON as one object per line, CSV with the
+// DefaultCSVColumns. Use format.ContentType() for the matching MIME type.
+func (um *UserManager) WriteUsers(w io.Writer, users []*User, format Format) error {
+	switch format {
+	case FormatJSON:
+		return writeJSONArray(w, slices.Values(users))
+	case FormatNDJSON:
+		return writeNDJSON(w, users)
+	case FormatCSV:
+		return um.writeCSV(w, users, DefaultCSVColumns)
+	case FormatXML:
+		return um.writeXML(w, users)
+	default:
+		return fmt.Errorf("unsupported format: %q", format)
+	}
+}
+
+// StreamUsersJSONArray writes a sequence of users to w as a single JSON
+// array, encoding one user at a time so memory use stays flat however many
+// users the sequence yields. An empty sequence produces []. When w is an
+// http.Flusher, such as an http.ResponseWriter, each user is flushed to the
+// client as soon as it is written.
+func (um *UserManager) StreamUsersJSONArray(w io.Writer, seq iter.Seq[*User]) error {
+	return writeJSONArray(w, seq)
+}
+
+// writeJSONArray writes users as a single JSON array, one element at a time,
+// flushing after each one if w supports it
+func writeJSONArray(w io.Writer, users iter.Seq[*User]) error {
+	flusher, _ := w.(http.Flusher)
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	first := true
+	for user := range users {
+		if user == nil {
+			continue
+		}
+		data, err := user.marshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal user %s: %w", user.ID, err)
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// writeNDJSON writes each user as a JSON object on its own line
+func writeNDJSON(w io.Writer, users []*User) error {
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		data, err := user.marshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal user %s: %w", user.ID, err)
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeXML writes users as an XML document, one user element at a time
+func (um *UserManager) writeXML(w io.Writer, users []*User) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	root := xml.StartElement{Name: xml.Name{Local: "users"}}
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+
+	userElement := xml.StartElement{Name: xml.Name{Local: "user"}}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		if err := encoder.EncodeElement(newXMLUser(user, um.timeFormat), userElement); err != nil {
+			return fmt.Errorf("failed to encode user %s: %w", user.ID, err)
+		}
+	}
+
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// xmlUsers is the document root written by ExportUsersXML
+type xmlUsers struct {
+	XMLName xml.Name  `xml:"users"`
+	Users   []xmlUser `xml:"user"`
+}
+
+// xmlUser is the XML form of a user
+type xmlUser struct {
+	ID        string             `xml:"id,attr"`
+	Name      string             `xml:"name"`
+	Email     string             `xml:"email"`
+	Status    string             `xml:"status"`
+	CreatedAt string             `xml:"created_at"`
+	Metadata  []xmlMetadataEntry `xml:"metadata>entry,omitempty"`
+}
+
+// xmlMetadataEntry is a single metadata key/value pair in XML
+type xmlMetadataEntry struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// newXMLUser snapshots u under its read lock, with metadata sorted by key
+func newXMLUser(u *User, timeFormat string) xmlUser {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	exported := xmlUser{
+		ID:        u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Status:    u.Status.String(),
+		CreatedAt: fmt.Sprint(formatTime(u.CreatedAt, timeFormat)),
+	}
+	for _, key := range slices.Sorted(maps.Keys(u.Metadata)) {
+		exported.Metadata = append(exported.Metadata, xmlMetadataEntry{
+			Key:   key,
+			Value: fmt.Sprint(u.Metadata[key]),
+		})
+	}
+	return exported
+}
+
+// ExportUsersXML exports users to XML format
+func (um *UserManager) ExportUsersXML(users []*User) (string, error) {
+	doc := xmlUsers{Users: make([]xmlUser, 0, len(users))}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		doc.Users = append(doc.Users, newXMLUser(user, um.timeFormat))
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal users: %w", err)
+	}
+	return xml.Header + string(data), nil
+}
+
 // ExportUsersJSON exports users to JSON format
 func (um *UserManager) ExportUsersJSON(users []*User) (string, error) {
 	data, err := json.MarshalIndent(users, "", "  ")
@@ -441,12 +5348,392 @@ func (um *UserManager) ExportUsersJSON(users []*User) (string, error) {
 	return string(data), nil
 }
 
+// DefaultCSVColumns are the columns written by ExportUsersCSV, in order
+var DefaultCSVColumns = []string{"id", "name", "email", "status", "created_at"}
+
+// csvMetadataPrefix selects a metadata key as a CSV column, e.g. "meta.plan"
+const csvMetadataPrefix = "meta."
+
+// ExportUsersCSV exports users to CSV with all of the DefaultCSVColumns
+func (um *UserManager) ExportUsersCSV(users []*User) (string, error) {
+	return um.ExportUsersCSVColumns(users, DefaultCSVColumns)
+}
+
+// ExportUsersCSVColumns exports users to CSV with the given columns, in the
+// given order. Columns are any of DefaultCSVColumns or "meta.<key>" for a
+// metadata value. Unknown columns are reported before anything is written.
+func (um *UserManager) ExportUsersCSVColumns(users []*User, columns []string) (string, error) {
+	var buf strings.Builder
+	if err := um.writeCSV(&buf, users, columns); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeCSV streams users to w as CSV with the given columns
+func (um *UserManager) writeCSV(w io.Writer, users []*User, columns []string) error {
+	if err := validateCSVColumns(columns); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(columns); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		if err := writer.Write(user.csvRecord(columns, um.timeFormat)); err != nil {
+			return fmt.Errorf("failed to write CSV row for user %s: %w", user.ID, err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+// validateCSVColumns checks that every column is known
+func validateCSVColumns(columns []string) error {
+	if len(columns) == 0 {
+		return errors.New("no CSV columns selected")
+	}
+	for _, column := range columns {
+		if slices.Contains(DefaultCSVColumns, column) {
+			continue
+		}
+		if key, ok := strings.CutPrefix(column, csvMetadataPrefix); ok && key != "" {
+			continue
+		}
+		return fmt.Errorf("unknown CSV column: %q", column)
+	}
+	return nil
+}
+
+// csvRecord returns the user's values for the given columns
+func (u *User) csvRecord(columns []string, timeFormat string) []string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "id":
+			record[i] = u.ID
+		case "name":
+			record[i] = u.Name
+		case "email":
+			record[i] = u.Email
+		case "status":
+			record[i] = u.Status.String()
+		case "created_at":
+			record[i] = fmt.Sprint(formatTime(u.CreatedAt, timeFormat))
+		default:
+			key := strings.TrimPrefix(column, csvMetadataPrefix)
+			if value, ok := u.Metadata[key]; ok && value != nil {
+				record[i] = fmt.Sprint(value)
+			}
+		}
+	}
+	return record
+}
+
+// ImportOptions controls how ImportUsersCSV reads timestamps and handles
+// invalid rows
+type ImportOptions struct {
+	FailFast   bool   // stop at the first invalid row instead of collecting errors
+	TimeFormat string // format created_at was exported with, see WithTimeFormat; RFC 3339 is always accepted
+}
+
+// RowError describes an invalid row encountered during import
+type RowError struct {
+	Line int
+	Err  error
+}
+
+// Error implements the error interface
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportUsersCSV reads users from CSV one row at a time. The first row must
+// be a header naming at least the id, name and email columns; status,
+// created_at and "meta.<key>" columns are optional and any other columns are
+// ignored. created_at is parsed with opts.TimeFormat or as RFC 3339. Invalid
+// rows are collected as RowErrors and skipped unless opts.FailFast is set, in
+// which case the first one is also returned as the error.
+func ImportUsersCSV(r io.Reader, opts ImportOptions) ([]*User, []RowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		columns[strings.TrimSpace(column)] = i
+	}
+	for _, required := range []string{"id", "name", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("missing required CSV column: %q", required)
+		}
+	}
+
+	var users []*User
+	var rowErrors []RowError
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var rowErr error
+		var user *User
+		var line int
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return users, rowErrors, fmt.Errorf("failed to read CSV: %w", err)
+			}
+			line, rowErr = parseErr.StartLine, parseErr.Err
+		} else {
+			line, _ = reader.FieldPos(0)
+			if len(record) != len(header) {
+				rowErr = fmt.Errorf("expected %d fields, got %d", len(header), len(record))
+			} else {
+				user, rowErr = userFromCSVRecord(columns, record, opts.TimeFormat)
+			}
+		}
+
+		if rowErr != nil {
+			rowError := RowError{Line: line, Err: rowErr}
+			rowErrors = append(rowErrors, rowError)
+			if opts.FailFast {
+				return users, rowErrors, rowError
+			}
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rowErrors, nil
+}
+
+// userFromCSVRecord builds a user from a record using the header positions,
+// parsing created_at with timeFormat or as RFC 3339
+func userFromCSVRecord(columns map[string]int, record []string, timeFormat string) (*User, error) {
+	user, err := NewUser(record[columns["id"]], record[columns["name"]], record[columns["email"]])
+	if err != nil {
+		return nil, err
+	}
+
+	if i, ok := columns["status"]; ok && record[i] != "" {
+		status, err := ParseUserStatus(record[i])
+		if err != nil {
+			return nil, err
+		}
+		user.Status = status
+	}
+
+	if i, ok := columns["created_at"]; ok && record[i] != "" {
+		createdAt, err := parseTime(record[i], timeFormat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_at: %w", err)
+		}
+		user.CreatedAt = createdAt.UTC()
+	}
+
+	for column, i := range columns {
+		if key, ok := strings.CutPrefix(column, csvMetadataPrefix); ok && key != "" && record[i] != "" {
+			user.Metadata[key] = record[i]
+		}
+	}
+
+	return user, nil
+}
+
+// RedactedValue replaces redacted metadata values in exports
+const RedactedValue = "[REDACTED]"
+
+// ExportOptions controls how users are written by the configurable exporters
+type ExportOptions struct {
+	MaskEmail          bool     // replace emails with their masked form
+	RedactMetadataKeys []string // metadata keys whose values are replaced with RedactedValue
+	OmitMetadata       bool     // leave metadata out entirely
+}
+
+// exportedUser is the wire form of a user written by configurable exporters
+type exportedUser struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Email     string      `json:"email"`
+	Status    UserStatus  `json:"status"`
+	CreatedAt interface{} `json:"created_at"`
+	Metadata  interface{} `json:"metadata,omitempty"`
+}
+
+// newExportedUser snapshots u under its read lock and applies opts and the
+// time format to the copy, leaving u itself untouched
+func newExportedUser(u *User, opts ExportOptions, timeFormat string) exportedUser {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	exported := exportedUser{
+		ID:        u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Status:    u.Status,
+		CreatedAt: formatTime(u.CreatedAt, timeFormat),
+	}
+	if opts.MaskEmail {
+		exported.Email = maskEmail(u.Email)
+	}
+
+	if !opts.OmitMetadata {
+		metadata := make(map[string]interface{}, len(u.Metadata))
+		for key, value := range u.Metadata {
+			metadata[key] = value
+		}
+		for _, key := range opts.RedactMetadataKeys {
+			if _, ok := metadata[key]; ok {
+				metadata[key] = RedactedValue
+			}
+		}
+		exported.Metadata = metadata
+	}
+
+	return exported
+}
+
+// ExportUsersJSONWith exports users to JSON after applying the masking and
+// redaction rules in opts. The input users are never modified.
+func (um *UserManager) ExportUsersJSONWith(users []*User, opts ExportOptions) (string, error) {
+	exported := make([]exportedUser, 0, len(users))
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		exported = append(exported, newExportedUser(user, opts, um.timeFormat))
+	}
+
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal users: %w", err)
+	}
+	return string(data), nil
+}
+
+// ExportUsersJSONStable exports users to JSON with every map key, including
+// those of nested metadata values, in sorted order so the output is
+// byte-for-byte stable for the same data
+func (um *UserManager) ExportUsersJSONStable(users []*User) (string, error) {
+	data, err := stableJSON(users)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal users: %w", err)
+	}
+	return string(data), nil
+}
+
+// stableJSON marshals v after round-tripping it through generic JSON values.
+// Every nested object becomes a map[string]interface{}, whose keys
+// encoding/json always writes in sorted order, regardless of the concrete
+// types or custom marshalers that produced it. Numbers are kept verbatim.
+func stableJSON(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(generic, "", "  ")
+}
+
 // Helper functions
 
-// isValidEmail validates email format using regex
+// emailRegex is the address format ValidateEmail accepts
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+// ValidateEmail checks email against the same rules the package enforces on
+// users, returning ErrInvalidEmail wrapped with the address if it fails
+func ValidateEmail(email string) error {
+	if !emailRegex.MatchString(email) {
+		return fmt.Errorf("%w: %s", ErrInvalidEmail, email)
+	}
+	return nil
+}
+
+// isValidEmail reports whether email passes ValidateEmail
 func isValidEmail(email string) bool {
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	return emailRegex.MatchString(email)
+	return ValidateEmail(email) == nil
+}
+
+// formatTime renders t using a Go layout or one of the epoch tokens. Epoch
+// formats produce integers; layouts produce strings.
+func formatTime(t time.Time, format string) interface{} {
+	switch format {
+	case TimeFormatUnix:
+		return t.Unix()
+	case TimeFormatUnixMilli:
+		return t.UnixMilli()
+	case "":
+		return t.Format(time.RFC3339)
+	default:
+		return t.Format(format)
+	}
+}
+
+// parseTime parses a timestamp written by formatTime with format, falling
+// back to RFC 3339
+func parseTime(value, format string) (time.Time, error) {
+	switch format {
+	case "", time.RFC3339:
+	case TimeFormatUnix, TimeFormatUnixMilli:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if format == TimeFormatUnix {
+				return time.Unix(n, 0), nil
+			}
+			return time.UnixMilli(n), nil
+		}
+	default:
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// maskEmail hides all but the first character of the local part of an
+// email address, e.g. "john@example.com" becomes "j***@example.com". The
+// first character is a whole rune, so the result stays valid UTF-8.
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	first, _ := utf8.DecodeRuneInString(email)
+	return string(first) + "***" + email[at:]
 }
 
 // UserOperations interface defines user operations
@@ -456,22 +5743,84 @@ type UserOperations interface {
 	IsExpired() bool
 }
 
-// GetAgeCategory returns the age category of the user
-func (u *User) GetAgeCategory() string {
-	days := u.DaysActive()
-	switch {
-	case days <= 30:
+// AgeCategory buckets users by how many days they have been active
+type AgeCategory int
+
+const (
+	AgeCategoryNew AgeCategory = iota
+	AgeCategoryRegular
+	AgeCategoryVeteran
+)
+
+// Day thresholds for the age categories: users active for at most
+// NewUserMaxDays are new, up to RegularUserMaxDays regular, veteran beyond
+var (
+	NewUserMaxDays     = 30
+	RegularUserMaxDays = 365
+)
+
+// String implements the Stringer interface
+func (c AgeCategory) String() string {
+	switch c {
+	case AgeCategoryNew:
 		return "New"
-	case days <= 365:
+	case AgeCategoryRegular:
 		return "Regular"
-	default:
+	case AgeCategoryVeteran:
 		return "Veteran"
+	default:
+		return "Unknown"
+	}
+}
+
+// IsValid reports whether c is one of the defined age categories
+func (c AgeCategory) IsValid() bool {
+	return c >= AgeCategoryNew && c <= AgeCategoryVeteran
+}
+
+// AgeCategoryValue returns the typed age category of the user
+func (u *User) AgeCategoryValue() AgeCategory {
+	days := u.DaysActive()
+	switch {
+	case days <= NewUserMaxDays:
+		return AgeCategoryNew
+	case days <= RegularUserMaxDays:
+		return AgeCategoryRegular
+	default:
+		return AgeCategoryVeteran
 	}
 }
 
+// GetAgeCategory returns the age category of the user
+func (u *User) GetAgeCategory() string {
+	return u.AgeCategoryValue().String()
+}
+
+// ExpiryThreshold is how long an inactive account may exist before it is
+// considered expired by IsExpired
+var ExpiryThreshold = 365 * 24 * time.Hour
+
 // IsExpired checks if the user account is expired (example logic)
 func (u *User) IsExpired() bool {
-	return u.DaysActive() > 365 && u.Status == StatusInactive
+	return u.IsExpiredAfter(ExpiryThreshold)
+}
+
+// IsExpiredAfter checks if the user is inactive and was created more than d ago
+func (u *User) IsExpiredAfter(d time.Duration) bool {
+	return u.isExpiredAt(time.Now(), d)
+}
+
+// IsExpiredAt is IsExpired as of the given time
+func (u *User) IsExpiredAt(now time.Time) bool {
+	return u.isExpiredAt(now, ExpiryThreshold)
+}
+
+// isExpiredAt checks if the user is inactive and was created more than d
+// before now
+func (u *User) isExpiredAt(now time.Time, d time.Duration) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.Status == StatusInactive && now.Sub(u.CreatedAt) > d
 }
 
 // Example usage and main function
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWeightedConcurrencySingleFetchDuringBatch(t *testing.T) {
+	unblock := make(chan struct{})
+	var batchInFlight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/users/")
+		if strings.HasPrefix(id, "slow") {
+			batchInFlight.Add(1)
+			<-unblock
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    map[string]interface{}{"id": id, "name": "User " + id, "email": id + "@example.com"},
+		})
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	um := NewUserManager(srv.URL, WithWeightedConcurrency(10, 3))
+
+	ids := []string{"slow1", "slow2", "slow3", "slow4", "slow5", "slow6", "slow7", "slow8"}
+	batchDone := make(chan map[string]*User, 1)
+	go func() {
+		batchDone <- um.BatchFetchUsers(context.Background(), ids)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for batchInFlight.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch requests in flight = %d, want 3", batchInFlight.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	user, err := um.FetchUser(ctx, "fast")
+	if err != nil {
+		t.Fatalf("FetchUser during batch: %v", err)
+	}
+	if user.ID != "fast" {
+		t.Errorf("FetchUser returned user %q, want %q", user.ID, "fast")
+	}
+
+	select {
+	case <-batchDone:
+		t.Fatal("batch finished while its requests were blocked")
+	default:
+	}
+}
+
+func TestWeightedSemaphorePriorityBypassesQueuedWaiters(t *testing.T) {
+	s := newWeightedSemaphore(4)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := s.Acquire(ctx, 2, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := make(chan error, 1)
+	go func() { batch <- s.Acquire(ctx, 2, false) }()
+	waitForWaiters(t, s, 1)
+
+	single := make(chan error, 1)
+	go func() { single <- s.Acquire(ctx, 1, true) }()
+	waitForWaiters(t, s, 2)
+
+	s.Release(2)
+	select {
+	case err := <-single:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("priority acquisition still waiting after units were released")
+	}
+	select {
+	case <-batch:
+		t.Fatal("ordinary waiter granted ahead of the priority one")
+	default:
+	}
+
+	s.Release(1)
+	s.Release(2)
+	if err := <-batch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForWaiters waits until s has n queued acquisitions
+func waitForWaiters(t *testing.T, s *weightedSemaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := len(s.waiters)
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("semaphore has %d waiters, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}